@@ -327,6 +327,7 @@ func (c *Client) Initialize(ctx context.Context, bankep, bankid, logep, logid st
 	v.Set("bank_appid", bankid)
 	v.Set("log_endpoint", logep)
 	v.Set("log_appid", logid)
+	v.Set("initial_isu", strconv.FormatInt(InitialIsu, 10))
 	res, err := c.post(ctx, "/initialize", v)
 	if err != nil {
 		return errors.Wrap(err, "POST /initialize request failed")
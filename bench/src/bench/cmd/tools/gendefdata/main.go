@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -130,14 +131,32 @@ func writeUserSQL(w io.Writer, tsv io.Writer, users []User) error {
 			return err
 		}
 	}
+	if _, err := fmt.Fprintln(w, ";"); err != nil {
+		return err
+	}
+	// 新規登録時と同じく最初から保有している椅子 (ベンチマーカーが POST /initialize で設定する脚数)
+	if _, err := fmt.Fprint(w, "INSERT INTO isu_ledger (user_id,order_id,trade_id,amount,created_at) VALUES "); err != nil {
+		return err
+	}
+	for i, user := range users {
+		if i > 0 {
+			if _, err := fmt.Fprint(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "(%d,0,0,%d,'%s')", user.ID, bench.InitialIsu, user.CreatedAt.Format(DF)); err != nil {
+			return err
+		}
+	}
 	_, err := fmt.Fprintln(w, ";")
 	return err
 }
 
 func writeOrderSQL(w io.Writer, orders []Order) error {
-	if _, err := fmt.Fprint(w, "INSERT INTO orders (id,type,user_id,amount,price,closed_at,trade_id,created_at) VALUES "); err != nil {
+	if _, err := fmt.Fprint(w, "INSERT INTO orders (id,type,user_id,amount,price,filled_amount,status,close_reason,closed_at,trade_id,created_at) VALUES "); err != nil {
 		return err
 	}
+	fills := 0
 	for i, order := range orders {
 		if i > 0 {
 			if _, err := fmt.Fprint(w, ","); err != nil {
@@ -147,19 +166,66 @@ func writeOrderSQL(w io.Writer, orders []Order) error {
 		if _, err := fmt.Fprintf(w, "(%d,'%s',%d,%d,%d", order.ID, order.Type, order.UserID, order.Amount, order.Price); err != nil {
 			return err
 		}
-		if _, err := fmt.Fprintf(w, ",'%s'", order.ClosedAt.Format(DF)); err != nil {
+		var filled int64
+		status, reason, tradeID := "canceled", "canceled", "NULL"
+		if order.TradeID != 0 {
+			filled = order.Amount
+			status, reason, tradeID = "traded", "", strconv.FormatInt(order.TradeID, 10)
+			fills++
+		}
+		if _, err := fmt.Fprintf(w, ",%d,'%s','%s','%s',%s", filled, status, reason, order.ClosedAt.Format(DF), tradeID); err != nil {
 			return err
 		}
+		if _, err := fmt.Fprintf(w, ",'%s')", order.CreatedAt.Format(DF)); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(w, ";"); err != nil {
+		return err
+	}
+	if fills == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprint(w, "INSERT INTO order_fill (order_id,trade_id,amount,created_at) VALUES "); err != nil {
+		return err
+	}
+	i := 0
+	for _, order := range orders {
 		if order.TradeID == 0 {
-			if _, err := fmt.Fprint(w, ",NULL"); err != nil {
+			continue
+		}
+		if i > 0 {
+			if _, err := fmt.Fprint(w, ","); err != nil {
 				return err
 			}
-		} else {
-			if _, err := fmt.Fprintf(w, ",%d", order.TradeID); err != nil {
+		}
+		i++
+		if _, err := fmt.Fprintf(w, "(%d,%d,%d,'%s')", order.ID, order.TradeID, order.Amount, order.ClosedAt.Format(DF)); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(w, ";"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(w, "INSERT INTO isu_ledger (user_id,order_id,trade_id,amount,created_at) VALUES "); err != nil {
+		return err
+	}
+	i = 0
+	for _, order := range orders {
+		if order.TradeID == 0 {
+			continue
+		}
+		if i > 0 {
+			if _, err := fmt.Fprint(w, ","); err != nil {
 				return err
 			}
 		}
-		if _, err := fmt.Fprintf(w, ",'%s')", order.CreatedAt.Format(DF)); err != nil {
+		i++
+		amount := order.Amount
+		if order.Type == "sell" {
+			amount *= -1
+		}
+		if _, err := fmt.Fprintf(w, "(%d,%d,%d,%d,'%s')", order.UserID, order.ID, order.TradeID, amount, order.ClosedAt.Format(DF)); err != nil {
 			return err
 		}
 	}
@@ -223,6 +289,7 @@ func run(dir, starts, ends string) error {
 	defer usersql.Close()
 	fmt.Fprintln(usersql, "use isucoin;")
 	fmt.Fprintln(usersql, "truncate user;")
+	fmt.Fprintln(usersql, "truncate isu_ledger;")
 	fmt.Fprintln(usersql, "set names utf8mb4;")
 	usercsv, err := os.Create(filepath.Join(dir, "app.user.tsv"))
 	if err != nil {
@@ -246,6 +313,7 @@ func run(dir, starts, ends string) error {
 	defer ordersql.Close()
 	fmt.Fprintln(ordersql, "use isucoin;")
 	fmt.Fprintln(ordersql, "truncate orders;")
+	fmt.Fprintln(ordersql, "truncate order_fill;")
 
 	tm, err := time.Parse(time.RFC3339, starts)
 	if err != nil {
@@ -96,7 +96,7 @@ func run(db *sql.DB, r io.Reader, w io.Writer) error {
 		if len(users) > 300 && u.Cost < 8 {
 			continue
 		}
-		if err = db.QueryRow("SELECT COUNT(*), COUNT(trade_id) FROM orders WHERE user_id = ?", record[0]).Scan(&u.Orders, &u.Traded); err != nil {
+		if err = db.QueryRow("SELECT COUNT(*), COUNT(NULLIF(filled_amount, 0)) FROM orders WHERE user_id = ?", record[0]).Scan(&u.Orders, &u.Traded); err != nil {
 			return err
 		}
 		if u.Orders < 50 {
@@ -38,4 +38,7 @@ const (
 	// error
 	AllowErrorMin = 20 // levelによらずここまでは許容範囲というエラー数
 	AllowErrorMax = 50 // levelによらずこれ以上は許さないというエラー数
+
+	// Initialize
+	InitialIsu = 1000 // 新規登録したユーザーが最初から保有している椅子の脚数
 )
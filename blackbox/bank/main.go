@@ -13,6 +13,7 @@ import (
 	//	"fmt"
 	//	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -80,6 +81,7 @@ func NewServer(db *sql.DB) http.Handler {
 	server.HandleFunc("/initialize", h.Initialize)
 	server.HandleFunc("/check", sleepHandle(h.Check, 50*time.Millisecond))
 	server.HandleFunc("/reserve", sleepHandle(h.Reserve, 70*time.Millisecond))
+	server.HandleFunc("/reserve_bulk", sleepHandle(h.ReserveBulk, 70*time.Millisecond))
 	server.HandleFunc("/commit", sleepHandle(h.Commit, 300*time.Millisecond))
 	server.HandleFunc("/cancel", sleepHandle(h.Cancel, 80*time.Millisecond))
 
@@ -319,36 +321,14 @@ func (s *Handler) Reserve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var rsvID int64
-	price := req.Price
 	memo := fmt.Sprintf("app:%s, price:%d", appid, req.Price)
 	err = s.txScope(func(tx *sql.Tx) error {
 		if _, err := tx.Exec(`SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
 			return errors.Wrap(err, "select lock failed")
 		}
-		now := time.Now()
-		expire := now.Add(5 * time.Minute)
-		isMinus := price < 0
-		if isMinus {
-			var fixed, reserved int64
-			if err := tx.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM credit WHERE user_id = ?`, userID).Scan(&fixed); err != nil {
-				return errors.Wrap(err, "calc credit failed")
-			}
-			if err := tx.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM reserve WHERE user_id = ? AND is_minus = 1 AND expire_at >= ?`, userID, now).Scan(&reserved); err != nil {
-				return errors.Wrap(err, "calc reserve failed")
-			}
-			if fixed+reserved+price < 0 {
-				return CreditIsInsufficient
-			}
-		}
-		query := `INSERT INTO reserve (user_id, amount, note, is_minus, created_at, expire_at) VALUES (?, ?, ?, ?, ?, ?)`
-		sr, err := tx.Exec(query, userID, price, memo, isMinus, now, expire)
-		if err != nil {
-			return errors.Wrap(err, "update user.credit failed")
-		}
-		if rsvID, err = sr.LastInsertId(); err != nil {
-			return errors.Wrap(err, "lastInsertID failed")
-		}
-		return nil
+		var err error
+		rsvID, err = s.reserve(tx, userID, req.Price, memo)
+		return err
 	})
 
 	switch {
@@ -363,6 +343,150 @@ func (s *Handler) Reserve(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// reserve はロック済みのユーザーの仮決済を行います
+func (s *Handler) reserve(tx *sql.Tx, userID, price int64, memo string) (int64, error) {
+	now := time.Now()
+	expire := now.Add(5 * time.Minute)
+	isMinus := price < 0
+	if isMinus {
+		var fixed, reserved int64
+		if err := tx.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM credit WHERE user_id = ?`, userID).Scan(&fixed); err != nil {
+			return 0, errors.Wrap(err, "calc credit failed")
+		}
+		if err := tx.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM reserve WHERE user_id = ? AND is_minus = 1 AND expire_at >= ?`, userID, now).Scan(&reserved); err != nil {
+			return 0, errors.Wrap(err, "calc reserve failed")
+		}
+		if fixed+reserved+price < 0 {
+			return 0, CreditIsInsufficient
+		}
+	}
+	query := `INSERT INTO reserve (user_id, amount, note, is_minus, created_at, expire_at) VALUES (?, ?, ?, ?, ?, ?)`
+	sr, err := tx.Exec(query, userID, price, memo, isMinus, now, expire)
+	if err != nil {
+		return 0, errors.Wrap(err, "update user.credit failed")
+	}
+	rsvID, err := sr.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "lastInsertID failed")
+	}
+	return rsvID, nil
+}
+
+// ReserveBulk は POST /reserve_bulk を処理
+// 複数の仮決済を1回で行います。atomicの場合は1件でも失敗すると全ての仮決済を行いません
+func (s *Handler) ReserveBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appid, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	type ReqItem struct {
+		BankID string `json:"bank_id"`
+		Price  int64  `json:"price"`
+	}
+	type ReqPram struct {
+		Reserves []ReqItem `json:"reserves"`
+		Atomic   bool      `json:"atomic"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		Error(w, "can't parse body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Reserves) == 0 {
+		Error(w, "reserves is required", http.StatusBadRequest)
+		return
+	}
+	type ResItem struct {
+		Status    int    `json:"status"`
+		ReserveID int64  `json:"reserve_id,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	results := make([]ResItem, len(req.Reserves))
+	userIDs := make([]int64, len(req.Reserves))
+	for i, item := range req.Reserves {
+		if item.Price == 0 {
+			Error(w, "price is 0", http.StatusBadRequest)
+			return
+		}
+		id, err := s.lookupBankID(item.BankID)
+		switch {
+		case err == sql.ErrNoRows:
+			results[i] = ResItem{Status: http.StatusNotFound, Error: "bank_id not found"}
+		case err != nil:
+			log.Printf("[WARN] get user failed. err: %s", err)
+			Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		userIDs[i] = id
+	}
+	failed := -1
+	err = s.txScope(func(tx *sql.Tx) error {
+		// デッドロックを避けるためにuser.idの順にロックする
+		locks := make([]int64, 0, len(userIDs))
+		for _, id := range userIDs {
+			if id > 0 {
+				locks = append(locks, id)
+			}
+		}
+		sort.Slice(locks, func(i, j int) bool { return locks[i] < locks[j] })
+		for i, id := range locks {
+			if i > 0 && locks[i-1] == id {
+				continue
+			}
+			if _, err := tx.Exec(`SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, id); err != nil {
+				return errors.Wrap(err, "select lock failed")
+			}
+		}
+		for i, item := range req.Reserves {
+			if userIDs[i] > 0 {
+				memo := fmt.Sprintf("app:%s, price:%d", appid, item.Price)
+				rsvID, err := s.reserve(tx, userIDs[i], item.Price, memo)
+				switch {
+				case err == CreditIsInsufficient:
+					results[i] = ResItem{Status: http.StatusBadRequest, Error: "credit is insufficient"}
+				case err != nil:
+					return err
+				default:
+					results[i] = ResItem{Status: http.StatusOK, ReserveID: rsvID}
+				}
+			}
+			if results[i].Status != http.StatusOK && failed < 0 {
+				failed = i
+			}
+		}
+		if req.Atomic && failed >= 0 {
+			return CreditIsInsufficient
+		}
+		return nil
+	})
+
+	status := http.StatusOK
+	res := map[string]interface{}{}
+	switch {
+	case err != nil && !(req.Atomic && err == CreditIsInsufficient):
+		log.Printf("[WARN] reserve bulk failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	case req.Atomic && failed >= 0:
+		for i := range results {
+			if results[i].Status == http.StatusOK {
+				results[i] = ResItem{Status: http.StatusConflict, Error: "reserve is not executed"}
+			}
+		}
+		status = results[failed].Status
+		res["error"] = results[failed].Error
+	}
+	res["results"] = results
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
 func (s *Handler) Commit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -565,15 +689,7 @@ func (s *Handler) filterBankID(w http.ResponseWriter, bankID string) int64 {
 		Error(w, "bank_id is required", http.StatusBadRequest)
 		return 0
 	}
-	cacheBankIDMutex.RLock()
-	if id, ok := cacheBankID[bankID]; ok {
-		cacheBankIDMutex.RUnlock()
-		return id
-	}
-	cacheBankIDMutex.RUnlock()
-
-	var id int64
-	err := s.db.QueryRow(`SELECT id FROM user WHERE bank_id = ? LIMIT 1`, bankID).Scan(&id)
+	id, err := s.lookupBankID(bankID)
 	switch {
 	case err == sql.ErrNoRows:
 		Error(w, "bank_id not found", http.StatusNotFound)
@@ -581,12 +697,28 @@ func (s *Handler) filterBankID(w http.ResponseWriter, bankID string) int64 {
 	case err != nil:
 		log.Printf("[WARN] get user failed. err: %s", err)
 		Error(w, "internal server error", http.StatusInternalServerError)
-		return 0 // クエリ失敗の時は cache しないで返る
+		return 0
+	}
+	return id
+}
+
+// lookupBankID はbank_idのユーザーのidを返します。存在しない場合はsql.ErrNoRowsを返します
+func (s *Handler) lookupBankID(bankID string) (int64, error) {
+	cacheBankIDMutex.RLock()
+	if id, ok := cacheBankID[bankID]; ok {
+		cacheBankIDMutex.RUnlock()
+		return id, nil
+	}
+	cacheBankIDMutex.RUnlock()
+
+	var id int64
+	if err := s.db.QueryRow(`SELECT id FROM user WHERE bank_id = ? LIMIT 1`, bankID).Scan(&id); err != nil {
+		return 0, err // クエリ失敗の時は cache しないで返る
 	}
 	cacheBankIDMutex.Lock()
 	cacheBankID[bankID] = id
 	cacheBankIDMutex.Unlock()
-	return id
+	return id, nil
 }
 
 func (s *Handler) txScope(f func(*sql.Tx) error) (err error) {
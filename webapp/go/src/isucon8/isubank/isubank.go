@@ -3,29 +3,109 @@ package isubank
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 )
 
 var (
-	// いすこん銀行にアカウントが存在しない
-	ErrNoUser = errors.New("no bank user")
+	// DefaultTimeout は1回のリクエストの期限です。ctxの期限の方が早い場合はctxの期限までとします
+	DefaultTimeout = 5 * time.Second
 
-	// 仮決済時または残高チェック時に残高が不足している
-	ErrCreditInsufficient = errors.New("credit is insufficient")
+	// MaxRetries は冪等なリクエスト(Check, Credit)が一時的なエラーで失敗したときに再送する回数です
+	MaxRetries = 2
+
+	// RetryBackoff は再送までの待ち時間です
+	RetryBackoff = 50 * time.Millisecond
 )
 
+// StatusError はISUBANK APIが200以外のステータスを返したことを表します
+// エラーの種類はPathとStatusCodeで判断し、Messageは表示にのみ使います
+type StatusError struct {
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("isubank %s failed. status: %d, err: %s", e.Path, e.StatusCode, e.Message)
+}
+
+// Temporary は時間を置いて再送すれば成功する可能性があるかを返します
+func (e *StatusError) Temporary() bool {
+	return temporaryStatus(e.StatusCode)
+}
+
+// DecodeError はISUBANK APIのレスポンスをJSONとして解釈できなかったことを表します
+type DecodeError struct {
+	Path       string
+	StatusCode int
+	Err        error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("isubank %s decode json failed. status: %d, err: %s", e.Path, e.StatusCode, e.Err)
+}
+
+// Temporary は時間を置いて再送すれば成功する可能性があるかを返します
+// プロキシなどがエラーを返した場合もJSONとして解釈できないため、ステータスで判断します
+func (e *DecodeError) Temporary() bool {
+	return temporaryStatus(e.StatusCode)
+}
+
+func temporaryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// NoUser はいすこん銀行にアカウントが存在しないことを表すかを返します
+// bank_idを指定するAPIは、アカウントが存在しない場合のみ404を返します
+func (e *StatusError) NoUser() bool {
+	switch e.Path {
+	case "/check", "/credit", "/reserve", "/reserve_bulk":
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// CreditInsufficient は仮決済時または残高チェック時に残高が不足していることを表すかを返します
+// 残高を確認するAPIは、パラメータが正しい場合は残高不足でのみ400を返します
+func (e *StatusError) CreditInsufficient() bool {
+	switch e.Path {
+	case "/check", "/reserve", "/reserve_bulk":
+		return e.StatusCode == http.StatusBadRequest
+	}
+	return false
+}
+
+// IsNoUser はerrがいすこん銀行にアカウントが存在しないことを表すStatusErrorかを返します
+func IsNoUser(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.NoUser()
+}
+
+// IsCreditInsufficient はerrが残高不足を表すStatusErrorかを返します
+func IsCreditInsufficient(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.CreditInsufficient()
+}
+
+// responseError は200以外のステータスのレスポンスをエラーにします
+func responseError(p string, code int, msg string) error {
+	return &StatusError{Path: p, StatusCode: code, Message: msg}
+}
+
 type isubankResponse interface {
-	setStatus(int)
+	errorMessage() string
 }
 
 type isubankBasicResponse struct {
-	status int
-	Error  string `json:"error"`
+	Error string `json:"error"`
 }
 
 type isubankReserveResponse struct {
@@ -33,12 +113,22 @@ type isubankReserveResponse struct {
 	ReserveID int64 `json:"reserve_id"`
 }
 
-func (r *isubankBasicResponse) success() bool {
-	return r.status == 200
+type isubankReserveBulkResponse struct {
+	isubankBasicResponse
+	Results []struct {
+		Status    int    `json:"status"`
+		ReserveID int64  `json:"reserve_id"`
+		Error     string `json:"error"`
+	} `json:"results"`
 }
 
-func (r *isubankBasicResponse) setStatus(s int) {
-	r.status = s
+type isubankCreditResponse struct {
+	isubankBasicResponse
+	Credit int64 `json:"credit"`
+}
+
+func (r *isubankBasicResponse) errorMessage() string {
+	return r.Error
 }
 
 // Isubank はISUBANK APIクライアントです
@@ -46,6 +136,7 @@ func (r *isubankBasicResponse) setStatus(s int) {
 type Isubank struct {
 	endpoint *url.URL
 	appID    string
+	client   *http.Client
 }
 
 // NewIsubank はIsubankを初期化します
@@ -53,6 +144,12 @@ type Isubank struct {
 // endpoint: ISUBANK APIを利用するためのエンドポイントURI
 // appID:    ISUBANK APIを利用するためのアプリケーションID
 func NewIsubank(endpoint, appID string) (*Isubank, error) {
+	return NewIsubankWithClient(endpoint, appID, http.DefaultClient)
+}
+
+// NewIsubankWithClient はリクエストに使うhttp.Clientを指定してIsubankを初期化します
+// Isubankは複数のgoroutineから利用できるため、clientと共に使い回してください
+func NewIsubankWithClient(endpoint, appID string, client *http.Client) (*Isubank, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
@@ -60,109 +157,216 @@ func NewIsubank(endpoint, appID string) (*Isubank, error) {
 	return &Isubank{
 		endpoint: u,
 		appID:    appID,
+		client:   client,
 	}, nil
 }
 
 // Check は残高確認です
 // Reserve による予約済み残高は含まれません
 func (b *Isubank) Check(bankID string, price int64) error {
-	res := &isubankBasicResponse{}
+	return b.CheckContext(context.Background(), bankID, price)
+}
+
+// CheckContext はctxを指定して残高確認を行います
+// 一時的なエラーの場合は再送します
+func (b *Isubank) CheckContext(ctx context.Context, bankID string, price int64) error {
 	v := map[string]interface{}{
 		"bank_id": bankID,
 		"price":   price,
 	}
-	if err := b.request("/check", v, res); err != nil {
-		return fmt.Errorf("check failed. err: %s", err)
-	}
-	if res.success() {
-		return nil
-	}
-	if res.Error == "bank_id not found" {
-		return ErrNoUser
-	}
-	if res.Error == "credit is insufficient" {
-		return ErrCreditInsufficient
+	return b.request(ctx, http.MethodPost, "/check", nil, v, &isubankBasicResponse{}, true)
+}
+
+// Credit は確定済みの残高を返します
+// Reserve による予約済み残高は含まれません
+func (b *Isubank) Credit(bankID string) (int64, error) {
+	return b.CreditContext(context.Background(), bankID)
+}
+
+// CreditContext はctxを指定して確定済みの残高を返します
+// 一時的なエラーの場合は再送します
+func (b *Isubank) CreditContext(ctx context.Context, bankID string) (int64, error) {
+	res := &isubankCreditResponse{}
+	q := url.Values{}
+	q.Set("bank_id", bankID)
+	if err := b.request(ctx, http.MethodGet, "/credit", q, nil, res, true); err != nil {
+		return 0, err
 	}
-	return fmt.Errorf("check failed. err:%s", res.Error)
+	return res.Credit, nil
 }
 
 // Reserve は仮決済(残高の確保)を行います
 func (b *Isubank) Reserve(bankID string, price int64) (int64, error) {
+	return b.ReserveContext(context.Background(), bankID, price)
+}
+
+// ReserveContext はctxを指定して仮決済を行います
+// 再送すると二重に仮決済されるおそれがあるため、再送しません
+func (b *Isubank) ReserveContext(ctx context.Context, bankID string, price int64) (int64, error) {
 	res := &isubankReserveResponse{}
 	v := map[string]interface{}{
 		"bank_id": bankID,
 		"price":   price,
 	}
-	if err := b.request("/reserve", v, res); err != nil {
-		return 0, fmt.Errorf("reserve failed. err: %s", err)
+	if err := b.request(ctx, http.MethodPost, "/reserve", nil, v, res, false); err != nil {
+		return 0, err
 	}
-	if !res.success() {
-		if res.Error == "credit is insufficient" {
-			return 0, ErrCreditInsufficient
+	return res.ReserveID, nil
+}
+
+// ReserveRequest は一括仮決済の1件です
+type ReserveRequest struct {
+	BankID string `json:"bank_id"`
+	Price  int64  `json:"price"`
+}
+
+// ReserveResult は一括仮決済の1件の結果です
+// Errがnilの場合はReserveIDに仮決済のIDが入ります。Errは1件ずつReserveした場合と同じエラーです
+type ReserveResult struct {
+	ReserveID int64
+	Err       error
+}
+
+// ReserveBulk は複数の仮決済を1回のリクエストで行います
+func (b *Isubank) ReserveBulk(reqs []ReserveRequest, atomic bool) ([]ReserveResult, error) {
+	return b.ReserveBulkContext(context.Background(), reqs, atomic)
+}
+
+// ReserveBulkContext はctxを指定して複数の仮決済を1回のリクエストで行い、reqsと同じ順に結果を返します
+// atomicがfalseの場合は1件ごとに仮決済を行います
+// atomicがtrueの場合は1件でも失敗すると全ての仮決済を行わず、最初に失敗した1件のエラーと共に結果を返します
+// 再送すると二重に仮決済されるおそれがあるため、再送しません
+func (b *Isubank) ReserveBulkContext(ctx context.Context, reqs []ReserveRequest, atomic bool) ([]ReserveResult, error) {
+	res := &isubankReserveBulkResponse{}
+	v := map[string]interface{}{
+		"reserves": reqs,
+		"atomic":   atomic,
+	}
+	err := b.request(ctx, http.MethodPost, "/reserve_bulk", nil, v, res, false)
+	if len(res.Results) != len(reqs) {
+		if err == nil {
+			err = fmt.Errorf("isubank /reserve_bulk returns %d results for %d reserves", len(res.Results), len(reqs))
 		}
-		return 0, fmt.Errorf("reserve failed. err:%s", res.Error)
+		return nil, err
 	}
-	return res.ReserveID, nil
+	results := make([]ReserveResult, len(reqs))
+	for i, r := range res.Results {
+		if r.Status == http.StatusOK {
+			results[i].ReserveID = r.ReserveID
+		} else {
+			results[i].Err = responseError("/reserve_bulk", r.Status, r.Error)
+		}
+	}
+	return results, err
 }
 
 // Commit は決済の確定を行います
 // 正常に仮決済処理を行っていればここでエラーになることはありません
 func (b *Isubank) Commit(reserveIDs []int64) error {
-	res := &isubankBasicResponse{}
+	return b.CommitContext(context.Background(), reserveIDs)
+}
+
+// CommitContext はctxを指定して決済の確定を行います
+// 確定済みの仮決済を再び確定するとエラーになるため、再送しません
+func (b *Isubank) CommitContext(ctx context.Context, reserveIDs []int64) error {
 	v := map[string]interface{}{
 		"reserve_ids": reserveIDs,
 	}
-	if err := b.request("/commit", v, res); err != nil {
-		return fmt.Errorf("commit failed. err: %s", err)
-	}
-	if !res.success() {
-		if res.Error == "credit is insufficient" {
-			return ErrCreditInsufficient
-		}
-		return fmt.Errorf("commit failed. err:%s", res.Error)
-	}
-	return nil
+	return b.request(ctx, http.MethodPost, "/commit", nil, v, &isubankBasicResponse{}, false)
 }
 
 // Cancel は決済の取り消しを行います
 func (b *Isubank) Cancel(reserveIDs []int64) error {
-	res := &isubankBasicResponse{}
+	return b.CancelContext(context.Background(), reserveIDs)
+}
+
+// CancelContext はctxを指定して決済の取り消しを行います
+// 取り消し済みの仮決済を再び取り消すとエラーになるため、再送しません
+func (b *Isubank) CancelContext(ctx context.Context, reserveIDs []int64) error {
 	v := map[string]interface{}{
 		"reserve_ids": reserveIDs,
 	}
-	if err := b.request("/cancel", v, res); err != nil {
-		return fmt.Errorf("cancel failed. err: %s", err)
-	}
-	if !res.success() {
-		return fmt.Errorf("cancel failed. err:%s", res.Error)
-	}
-	return nil
+	return b.request(ctx, http.MethodPost, "/cancel", nil, v, &isubankBasicResponse{}, false)
 }
 
-func (b *Isubank) request(p string, v interface{}, r isubankResponse) error {
+func (b *Isubank) url(p string) *url.URL {
 	u := new(url.URL)
 	*u = *b.endpoint
 	u.Path = path.Join(u.Path, p)
+	return u
+}
 
-	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(v); err != nil {
-		return fmt.Errorf("isubank json encode failed. err: %s", err)
+// request はAPIを呼び出し、レスポンスをrに読み込みます。vがnilでない場合はJSONにしてbodyで送ります
+// idempotentな呼び出しは一時的なエラーの場合にMaxRetries回まで再送します
+func (b *Isubank) request(ctx context.Context, method, p string, q url.Values, v interface{}, r isubankResponse, idempotent bool) error {
+	var body []byte
+	if v != nil {
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return fmt.Errorf("isubank json encode failed. err: %s", err)
+		}
 	}
-	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	for i := 0; ; i++ {
+		err := b.do(ctx, method, p, q, body, r)
+		if err == nil || !idempotent || i >= MaxRetries || !temporary(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(RetryBackoff):
+		}
+	}
+}
+
+// temporary は再送すれば成功する可能性があるエラーかを返します
+func temporary(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.Temporary()
+	case *DecodeError:
+		return e.Temporary()
+	case *url.Error:
+		// 通信エラー。期限切れの場合も含む
+		return true
+	}
+	return false
+}
+
+func (b *Isubank) do(ctx context.Context, method, p string, q url.Values, body []byte, r isubankResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	u := b.url(p)
+	u.RawQuery = q.Encode()
+	var rb io.Reader
+	if body != nil {
+		rb = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), rb)
 	if err != nil {
 		return fmt.Errorf("isubank new request failed. err: %s", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	req.Header.Set("Authorization", "Bearer "+b.appID)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := b.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("isubank request failed. err: %s", err)
+		return err
 	}
-	defer res.Body.Close()
+	defer func() {
+		// 接続を再利用するため読み残しを捨てる
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
 	if err = json.NewDecoder(res.Body).Decode(r); err != nil {
-		return fmt.Errorf("isubank decode json failed. err: %s", err)
+		return &DecodeError{Path: p, StatusCode: res.StatusCode, Err: err}
+	}
+	if res.StatusCode != http.StatusOK {
+		return responseError(p, res.StatusCode, r.errorMessage())
 	}
-	r.setStatus(res.StatusCode)
 	return nil
 }
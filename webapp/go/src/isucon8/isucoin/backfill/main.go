@@ -0,0 +1,77 @@
+// backfill はtradeテーブルからロウソク足を作り直します
+// DBの接続先はwebappと同じ環境変数で指定します
+//
+//	go run ./backfill/main.go -since "2018-10-16 10:00:00"
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"isucon8/isucoin/model"
+	"log"
+	"os"
+	"time"
+)
+
+func init() {
+	var err error
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		log.Panicln(err)
+	}
+	time.Local = loc
+}
+
+func getEnv(key, def string) string {
+	if v, ok := os.LookupEnv("ISU_" + key); ok {
+		return v
+	}
+	return def
+}
+
+func main() {
+	var (
+		dbhost = getEnv("DB_HOST", "127.0.0.1")
+		dbport = getEnv("DB_PORT", "3306")
+		dbuser = getEnv("DB_USER", "root")
+		dbpass = getEnv("DB_PASSWORD", "")
+		dbname = getEnv("DB_NAME", "isucoin")
+	)
+	sinceStr := flag.String("since", "", "この時刻以降の取引を含む足を作り直す(2006-01-02 15:04:05形式)。未指定の場合は全ての足を作り直す")
+	flag.Parse()
+
+	since := time.Unix(0, 0)
+	if *sinceStr != "" {
+		var err error
+		since, err = time.ParseInLocation("2006-01-02 15:04:05", *sinceStr, time.Local)
+		if err != nil {
+			log.Fatalf("invalid since. err: %s", err)
+		}
+	}
+
+	dbusrpass := dbuser
+	if dbpass != "" {
+		dbusrpass += ":" + dbpass
+	}
+
+	dsn := fmt.Sprintf(`%s@tcp(%s:%s)/%s?parseTime=true&loc=Local&charset=utf8mb4`, dbusrpass, dbhost, dbport, dbname)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatalf("mysql connect failed. err: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("begin transaction failed. err: %s", err)
+	}
+	if err = model.RebuildCandlesticks(tx, since); err != nil {
+		tx.Rollback()
+		log.Fatalf("rebuild candlesticks failed. err: %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		log.Fatalf("commit failed. err: %s", err)
+	}
+	log.Printf("[INFO] rebuilt candlesticks since %s", since.Format("2006-01-02 15:04:05"))
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"isucon8/isucoin/model"
@@ -23,30 +27,41 @@ const (
 var BaseTime time.Time
 
 type Handler struct {
-	db    *sql.DB
-	store sessions.Store
+	db      *sql.DB
+	store   SessionStore
+	matcher *model.Matcher
 }
 
-func NewHandler(db *sql.DB, store sessions.Store) *Handler {
+func NewHandler(db *sql.DB, store SessionStore, matcher *model.Matcher) *Handler {
 	// ISUCON用初期データの基準時間です
 	// この時間以降のデータはInitializeで削除されます
 	BaseTime = time.Date(2018, 10, 16, 10, 0, 0, 0, time.Local)
 	return &Handler{
-		db:    db,
-		store: store,
+		db:      db,
+		store:   store,
+		matcher: matcher,
 	}
 }
 
 func (h *Handler) Initialize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// 処理中のトレードを終わらせてから初期化する
+	h.matcher.Drain()
 	err := h.txScope(func(tx *sql.Tx) error {
 		if err := model.InitBenchmark(tx); err != nil {
 			return err
 		}
+		if err := model.InitCandlesticks(tx, BaseTime); err != nil {
+			return err
+		}
 		for _, k := range []string{
 			model.BankEndpoint,
 			model.BankAppid,
 			model.LogEndpoint,
 			model.LogAppid,
+			model.MakerFeeRate,
+			model.TakerFeeRate,
+			model.FeeBankID,
+			model.InitialIsu,
 		} {
 			if err := model.SetSetting(tx, k, r.FormValue(k)); err != nil {
 				return errors.Wrapf(err, "set setting failed. %s", k)
@@ -54,11 +69,23 @@ func (h *Handler) Initialize(w http.ResponseWriter, r *http.Request, _ httproute
 		}
 		return nil
 	})
+	// コミットまたはロールバック後の設定を読み直させる
+	model.InvalidateSettings()
 	if err != nil {
 		h.handleError(w, err, 500)
-	} else {
-		h.handleSuccess(w, struct{}{})
+		return
 	}
+	if err = h.store.Reset(); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	if err = model.InitOrderBook(h.db); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	model.PublishBestPrice()
+	h.matcher.Trigger()
+	h.handleSuccess(w, struct{}{})
 }
 
 func (h *Handler) Signup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -69,13 +96,28 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		h.handleError(w, errors.New("all parameters are required"), 400)
 		return
 	}
-	err := h.txScope(func(tx *sql.Tx) error {
+	attempt, err := model.BeginLoginAttempt(h.db, "signup", bankID, clientIP(r))
+	if err != nil {
+		if err == model.ErrTooManyFailures {
+			h.handleError(w, err, 403)
+		} else {
+			h.handleError(w, err, 500)
+		}
+		return
+	}
+	err = h.txScope(func(tx *sql.Tx) error {
 		return model.UserSignup(tx, name, bankID, password)
 	})
-	switch {
-	case err == model.ErrBankUserNotFound:
-		// TODO: 失敗が多いときに403を返すBanの仕様に対応
+	if err == model.ErrBankUserNotFound {
+		attempt.Fail(h.db, err)
 		h.handleError(w, err, 404)
+		return
+	}
+	// 銀行ユーザーが見つかった場合はログイン失敗として数えない
+	if cerr := attempt.Cancel(h.db); cerr != nil {
+		log.Printf("[WARN] cancel login attempt failed. err:%s", cerr)
+	}
+	switch {
 	case err == model.ErrBankUserConflict:
 		h.handleError(w, err, 409)
 	case err != nil:
@@ -92,19 +134,40 @@ func (h *Handler) Signin(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		h.handleError(w, errors.New("all parameters are required"), 400)
 		return
 	}
+	attempt, err := model.BeginLoginAttempt(h.db, "signin", bankID, clientIP(r))
+	if err != nil {
+		if err == model.ErrTooManyFailures {
+			h.handleError(w, err, 403)
+		} else {
+			h.handleError(w, err, 500)
+		}
+		return
+	}
 	user, err := model.UserLogin(h.db, bankID, password)
 	switch {
 	case err == model.ErrUserNotFound:
-		// TODO: 失敗が多いときに403を返すBanの仕様に対応
+		attempt.Fail(h.db, err)
 		h.handleError(w, err, 404)
 	case err != nil:
+		if cerr := attempt.Cancel(h.db); cerr != nil {
+			log.Printf("[WARN] cancel login attempt failed. err:%s", cerr)
+		}
 		h.handleError(w, err, 500)
 	default:
+		if err = attempt.Succeed(h.db); err != nil {
+			h.handleError(w, err, 500)
+			return
+		}
 		session, err := h.store.Get(r, SessionName)
 		if err != nil {
 			h.handleError(w, err, 500)
 			return
 		}
+		// ログイン前のセッションIDを引き継がないよう新しいセッションIDを発行する
+		if err = h.store.Renew(session); err != nil {
+			h.handleError(w, err, 500)
+			return
+		}
 		session.Values["user_id"] = user.ID
 		if err = session.Save(r, w); err != nil {
 			h.handleError(w, err, 500)
@@ -129,6 +192,21 @@ func (h *Handler) Signout(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	h.handleSuccess(w, struct{}{})
 }
 
+// SignoutAll はログイン中のユーザーの全てのセッションを無効にします
+func (h *Handler) SignoutAll(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	if err = h.store.Revoke(user.ID); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	http.SetCookie(w, sessions.NewCookie(SessionName, "", &sessions.Options{MaxAge: -1}))
+	h.handleSuccess(w, struct{}{})
+}
+
 func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var (
 		err         error
@@ -161,11 +239,9 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 			h.handleError(w, err, 500)
 			return
 		}
-		for _, order := range orders {
-			if err = model.FetchOrderRelation(h.db, order); err != nil {
-				h.handleError(w, err, 500)
-				return
-			}
+		if err = model.FetchOrdersRelation(h.db, orders); err != nil {
+			h.handleError(w, err, 500)
+			return
 		}
 		res["traded_orders"] = orders
 	}
@@ -174,7 +250,7 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	if lt.After(bySecTime) {
 		bySecTime = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), lt.Second(), 0, lt.Location())
 	}
-	res["chart_by_sec"], err = model.GetCandlestickData(h.db, bySecTime, "%Y-%m-%d %H:%i:%s")
+	res["chart_by_sec"], err = model.GetCandlestickData(h.db, bySecTime, model.CandlestickBySec)
 	if err != nil {
 		h.handleError(w, errors.Wrap(err, "model.GetCandlestickData by sec"), 500)
 		return
@@ -184,7 +260,7 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	if lt.After(byMinTime) {
 		byMinTime = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), 0, 0, lt.Location())
 	}
-	res["chart_by_min"], err = model.GetCandlestickData(h.db, byMinTime, "%Y-%m-%d %H:%i:00")
+	res["chart_by_min"], err = model.GetCandlestickData(h.db, byMinTime, model.CandlestickByMin)
 	if err != nil {
 		h.handleError(w, errors.Wrap(err, "model.GetCandlestickData by min"), 500)
 		return
@@ -194,7 +270,7 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	if lt.After(byHourTime) {
 		byHourTime = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), 0, 0, 0, lt.Location())
 	}
-	res["chart_by_hour"], err = model.GetCandlestickData(h.db, byHourTime, "%Y-%m-%d %H:00:00")
+	res["chart_by_hour"], err = model.GetCandlestickData(h.db, byHourTime, model.CandlestickByHour)
 	if err != nil {
 		h.handleError(w, errors.Wrap(err, "model.GetCandlestickData by hour"), 500)
 		return
@@ -225,6 +301,58 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	h.handleSuccess(w, res)
 }
 
+func (h *Handler) GetOrderBook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	depth := 10
+	if _depth := r.URL.Query().Get("depth"); _depth != "" {
+		var err error
+		if depth, err = strconv.Atoi(_depth); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	ob, err := model.GetOrderBook(h.db, depth)
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, errors.Wrap(err, "model.GetOrderBook"), 500)
+	default:
+		h.handleSuccess(w, ob)
+	}
+}
+
+func (h *Handler) GetCandles(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	resolution := q.Get("resolution")
+	var from, to time.Time
+	if _from := q.Get("from"); _from != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, _from); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	if _to := q.Get("to"); _to != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, _to); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	candles, err := model.GetCandlestickDataRange(h.db, resolution, from, to)
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, errors.Wrap(err, "model.GetCandlestickDataRange"), 500)
+	default:
+		h.handleSuccess(w, map[string]interface{}{
+			"resolution": resolution,
+			"candles":    candles,
+		})
+	}
+}
+
 func (h *Handler) AddOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	user, err := h.userByRequest(r)
 	if err != nil {
@@ -233,55 +361,301 @@ func (h *Handler) AddOrders(w http.ResponseWriter, r *http.Request, _ httprouter
 	}
 	amount, _ := strconv.ParseInt(r.FormValue("amount"), 10, 64)
 	price, _ := strconv.ParseInt(r.FormValue("price"), 10, 64)
+	opt := model.OrderOption{
+		OrderType:   r.FormValue("order_type"),
+		TimeInForce: r.FormValue("time_in_force"),
+	}
+	if _expireAt := r.FormValue("expire_at"); _expireAt != "" {
+		expireAt, err := time.Parse(time.RFC3339, _expireAt)
+		if err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+		opt.ExpireAt = &expireAt
+	}
+	if _stopPrice := r.FormValue("stop_price"); _stopPrice != "" {
+		stopPrice, err := strconv.ParseInt(_stopPrice, 10, 64)
+		if err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+		h.addStopOrder(w, user, r.FormValue("type"), amount, price, stopPrice, opt)
+		return
+	}
 	var order *model.Order
 	err = h.txScope(func(tx *sql.Tx) (err error) {
-		order, err = model.AddOrder(tx, r.FormValue("type"), user.ID, amount, price)
+		order, err = model.AddOrder(tx, r.FormValue("type"), user.ID, amount, price, opt)
 		return
 	})
 	switch {
-	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient:
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient:
 		h.handleError(w, err, 400)
 	case err != nil:
 		h.handleError(w, err, 500)
 	default:
-		tradeChance, err := model.HasTradeChanceByOrder(h.db, order.ID)
+		model.PublishBestPrice()
+		// トレードはmatcherで非同期に行う
+		if order.IsImmediate() {
+			h.matcher.Submit(order.ID)
+		} else if model.HasTradeChanceByOrder(order.ID) {
+			h.matcher.Trigger()
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"id": order.ID,
+		})
+	}
+}
+
+func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	q := r.URL.Query()
+	filter := model.OrderFilter{
+		Status: q.Get("status"),
+		Type:   q.Get("type"),
+	}
+	if _from := q.Get("from"); _from != "" {
+		from, err := time.Parse(time.RFC3339, _from)
 		if err != nil {
-			h.handleError(w, err, 500)
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+		filter.From = &from
+	}
+	if _to := q.Get("to"); _to != "" {
+		to, err := time.Parse(time.RFC3339, _to)
+		if err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
 			return
 		}
-		if tradeChance {
-			if err := model.RunTrade(h.db); err != nil {
-				// トレードに失敗してもエラーにはしない
-				log.Printf("runTrade err:%s", err)
+		filter.To = &to
+	}
+	if _cursor := q.Get("cursor"); _cursor != "" {
+		if filter.Cursor, err = strconv.ParseInt(_cursor, 10, 64); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	if _limit := q.Get("limit"); _limit != "" {
+		if filter.Limit, err = strconv.Atoi(_limit); err != nil || filter.Limit <= 0 || filter.Limit > 1000 {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	// 未発動の逆指値注文はページングせず、最初のページにのみ含める
+	stops := []*model.StopOrder{}
+	if (filter.Status == "" || filter.Status == model.StopOrderStatusPending) && filter.Cursor == 0 {
+		if stops, err = model.GetPendingStopOrdersByUserID(h.db, user.ID, filter); err != nil {
+			if err == model.ErrParameterInvalid {
+				h.handleError(w, err, 400)
+			} else {
+				h.handleError(w, err, 500)
 			}
+			return
 		}
+	}
+	if filter.Status == model.StopOrderStatusPending {
+		h.handleSuccess(w, stops)
+		return
+	}
+	orders, next, err := model.GetOrdersByUserID(h.db, user.ID, filter)
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+		return
+	case err != nil:
+		h.handleError(w, err, 500)
+		return
+	}
+	if err = model.FetchOrdersRelation(h.db, orders); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	if next > 0 {
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(next, 10))
+	}
+	if len(stops) == 0 {
+		h.handleSuccess(w, orders)
+		return
+	}
+	list := make([]interface{}, 0, len(stops)+len(orders))
+	for _, stop := range stops {
+		list = append(list, stop)
+	}
+	for _, order := range orders {
+		list = append(list, order)
+	}
+	h.handleSuccess(w, list)
+}
+
+func (h *Handler) DeleteOrders(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	err = h.txScope(func(tx *sql.Tx) error {
+		return model.DeleteOrder(tx, user.ID, id, model.CancelReasonCanceled)
+	})
+	switch {
+	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
+		h.handleError(w, err, 404)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.PublishBestPrice()
 		h.handleSuccess(w, map[string]interface{}{
-			"id": order.ID,
+			"id": id,
 		})
 	}
 }
 
-func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+// addStopOrder は逆指値注文を登録します
+func (h *Handler) addStopOrder(w http.ResponseWriter, user *model.User, ot string, amount, price, stopPrice int64, opt model.OrderOption) {
+	var stop *model.StopOrder
+	err := h.txScope(func(tx *sql.Tx) (err error) {
+		stop, err = model.AddStopOrder(tx, ot, user.ID, amount, price, stopPrice, opt)
+		return
+	})
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		// 既に発動条件を満たしている場合はmatcherで発動させる
+		h.matcher.Trigger()
+		h.handleSuccess(w, map[string]interface{}{
+			"stop_order_id": stop.ID,
+		})
+	}
+}
+
+func (h *Handler) AddOrdersBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	user, err := h.userByRequest(r)
 	if err != nil {
 		h.handleError(w, err, 401)
 		return
 	}
-	orders, err := model.GetOrdersByUserID(h.db, user.ID)
-	if err != nil {
+	var body struct {
+		Orders []model.OrderRequest `json:"orders"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		h.handleError(w, model.ErrParameterInvalid, 400)
+		return
+	}
+	var (
+		orders []*model.Order
+		errs   []error
+	)
+	err = h.txScope(func(tx *sql.Tx) (err error) {
+		orders, errs, err = model.AddOrders(tx, user.ID, body.Orders)
+		return
+	})
+	switch {
+	case err == model.ErrBatchFailed:
+		h.handleBatchError(w, err, errs)
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
 		h.handleError(w, err, 500)
+	default:
+		model.PublishBestPrice()
+		// トレードはmatcherで非同期に行う
+		trigger := false
+		results := make([]map[string]interface{}, 0, len(orders))
+		for _, order := range orders {
+			if order.IsImmediate() {
+				h.matcher.Submit(order.ID)
+			} else if !trigger && model.HasTradeChanceByOrder(order.ID) {
+				trigger = true
+			}
+			results = append(results, map[string]interface{}{"id": order.ID})
+		}
+		if trigger {
+			h.matcher.Trigger()
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"results": results,
+		})
+	}
+}
+
+func (h *Handler) DeleteOrdersBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
 		return
 	}
-	for _, order := range orders {
-		if err = model.FetchOrderRelation(h.db, order); err != nil {
-			h.handleError(w, err, 500)
+	if _, ok := r.URL.Query()["ids"]; !ok {
+		h.cancelAllOrders(w, user, r.URL.Query().Get("type"))
+		return
+	}
+	ids := []int64{}
+	for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
 			return
 		}
+		ids = append(ids, id)
+	}
+	var errs []error
+	err = h.txScope(func(tx *sql.Tx) (err error) {
+		errs, err = model.DeleteOrders(tx, user.ID, ids, model.CancelReasonCanceled)
+		return
+	})
+	switch {
+	case err == model.ErrBatchFailed:
+		h.handleBatchError(w, err, errs)
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.PublishBestPrice()
+		results := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			results = append(results, map[string]interface{}{"id": id})
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"results": results,
+		})
 	}
-	h.handleSuccess(w, orders)
 }
 
-func (h *Handler) DeleteOrders(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// cancelAllOrders はユーザーの未成立の注文を全て取り消します
+func (h *Handler) cancelAllOrders(w http.ResponseWriter, user *model.User, ot string) {
+	var ids []int64
+	err := h.txScope(func(tx *sql.Tx) (err error) {
+		ids, err = model.CancelAllOrders(tx, user.ID, ot, model.CancelReasonCanceled)
+		return
+	})
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.PublishBestPrice()
+		results := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			results = append(results, map[string]interface{}{"id": id})
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"results": results,
+		})
+	}
+}
+
+func (h *Handler) DeleteStopOrder(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	user, err := h.userByRequest(r)
 	if err != nil {
 		h.handleError(w, err, 401)
@@ -289,7 +663,7 @@ func (h *Handler) DeleteOrders(w http.ResponseWriter, r *http.Request, p httprou
 	}
 	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
 	err = h.txScope(func(tx *sql.Tx) error {
-		return model.DeleteOrder(tx, user.ID, id, "canceled")
+		return model.DeleteStopOrder(tx, user.ID, id, model.CancelReasonCanceled)
 	})
 	switch {
 	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
@@ -298,7 +672,148 @@ func (h *Handler) DeleteOrders(w http.ResponseWriter, r *http.Request, p httprou
 		h.handleError(w, err, 500)
 	default:
 		h.handleSuccess(w, map[string]interface{}{
-			"id": id,
+			"stop_order_id": id,
+		})
+	}
+}
+
+func (h *Handler) AmendOrder(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	amount, _ := strconv.ParseInt(r.FormValue("amount"), 10, 64)
+	price, _ := strconv.ParseInt(r.FormValue("price"), 10, 64)
+	var order *model.Order
+	err = h.txScope(func(tx *sql.Tx) (err error) {
+		order, err = model.AmendOrder(tx, user.ID, id, amount, price)
+		return
+	})
+	switch {
+	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
+		h.handleError(w, err, 404)
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.PublishBestPrice()
+		if order.ID != id && model.HasTradeChanceByOrder(order.ID) {
+			h.matcher.Trigger()
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"id": order.ID,
+		})
+	}
+}
+
+// Stream はトレードの成立、最良気配、ロウソク足の更新と、ログインユーザーの注文の約定をServer-Sent Eventsで配信します
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.handleError(w, errors.New("streaming unsupported"), 500)
+		return
+	}
+	// ユーザーの存在はセッションで確認済みのため、DBは参照しない
+	userID, _ := r.Context().Value("user_id").(int64)
+	sub := model.Subscribe(userID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-sub.C:
+			if !ok {
+				// 受信が遅れて切断されたかサーバーの終了
+				return
+			}
+			data, err := json.Marshal(ev.Data)
+			if err != nil {
+				log.Printf("[WARN] marshal stream event failed. %s", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	balance, err := model.GetBalance(h.db, user)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	h.handleSuccess(w, balance)
+}
+
+func (h *Handler) GetPortfolio(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	portfolio, err := model.GetPortfolio(h.db, user.ID)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	h.handleSuccess(w, portfolio)
+}
+
+func (h *Handler) GetPortfolioHistory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	q := r.URL.Query()
+	resolution := q.Get("resolution")
+	var from, to time.Time
+	if _from := q.Get("from"); _from != "" {
+		if from, err = time.Parse(time.RFC3339, _from); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	if _to := q.Get("to"); _to != "" {
+		if to, err = time.Parse(time.RFC3339, _to); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	points, err := model.GetPortfolioHistory(h.db, user.ID, resolution, from, to)
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, errors.Wrap(err, "model.GetPortfolioHistory"), 500)
+	default:
+		h.handleSuccess(w, map[string]interface{}{
+			"resolution": resolution,
+			"history":    points,
 		})
 	}
 }
@@ -316,24 +831,10 @@ func (h *Handler) CommonMiddleware(f http.Handler) http.Handler {
 			h.handleError(w, err, 500)
 			return
 		}
-		if _userID, ok := session.Values["user_id"]; ok {
-			userID := _userID.(int64)
-			user, err := model.GetUserByID(h.db, userID)
-			switch {
-			case err == sql.ErrNoRows:
-				session.Values["user_id"] = 0
-				session.Options = &sessions.Options{MaxAge: -1}
-				if err = session.Save(r, w); err != nil {
-					h.handleError(w, err, 500)
-					return
-				}
-				h.handleError(w, errors.New("セッションが切断されました"), 404)
-				return
-			case err != nil:
-				h.handleError(w, err, 500)
-				return
-			}
-			ctx := context.WithValue(r.Context(), "user_id", user.ID)
+		// セッションはサーバー側で管理しており、ユーザーの削除時やサインアウト時に無効にしているため
+		// セッションが存在すればユーザーも存在する
+		if userID, ok := session.Values["user_id"].(int64); ok && userID > 0 {
+			ctx := context.WithValue(r.Context(), "user_id", userID)
 			f.ServeHTTP(w, r.WithContext(ctx))
 		} else {
 			f.ServeHTTP(w, r)
@@ -350,17 +851,38 @@ func (h *Handler) userByRequest(r *http.Request) (*model.User, error) {
 }
 
 func (h *Handler) handleSuccess(w http.ResponseWriter, data interface{}) {
-	w.WriteHeader(200)
+	h.handleJSON(w, 200, data)
+}
+
+func (h *Handler) handleJSON(w http.ResponseWriter, code int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		log.Printf("[WARN] write response json failed. %s", err)
 	}
 }
 
+// handleBatchError は一括処理の失敗を項目ごとのエラーとともに返します
+func (h *Handler) handleBatchError(w http.ResponseWriter, err error, errs []error) {
+	log.Printf("[WARN] err: %s", err.Error())
+	results := make([]map[string]interface{}, len(errs))
+	for i, e := range errs {
+		results[i] = map[string]interface{}{}
+		if e != nil {
+			results[i]["error"] = e.Error()
+		}
+	}
+	h.handleJSON(w, 400, map[string]interface{}{
+		"code":    400,
+		"err":     err.Error(),
+		"results": results,
+	})
+}
+
 func (h *Handler) handleError(w http.ResponseWriter, err error, code int) {
-	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
 	log.Printf("[WARN] err: %s", err.Error())
 	data := map[string]interface{}{
 		"code": code,
@@ -371,6 +893,48 @@ func (h *Handler) handleError(w http.ResponseWriter, err error, code int) {
 	}
 }
 
+// TrustedProxies はX-Forwarded-Forを信用するリバースプロキシのアドレスです
+// 空の場合はX-Forwarded-Forを使わず、接続元のアドレスをリクエスト元とします
+var TrustedProxies []*net.IPNet
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP はリクエスト元のIPアドレスを返します
+// X-Forwarded-Forはクライアントが自由に指定できるため、接続元が TrustedProxies の場合のみ後ろから辿り、
+// 信用するリバースプロキシ以外の最初のアドレスを利用します
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
 func (h *Handler) txScope(f func(*sql.Tx) error) (err error) {
 	var tx *sql.Tx
 	tx, err = h.db.Begin()
@@ -379,12 +943,12 @@ func (h *Handler) txScope(f func(*sql.Tx) error) (err error) {
 	}
 	defer func() {
 		if e := recover(); e != nil {
-			tx.Rollback()
+			model.RollbackTx(tx)
 			err = errors.Errorf("panic in transaction: %s", e)
 		} else if err != nil {
-			tx.Rollback()
+			model.RollbackTx(tx)
 		} else {
-			err = tx.Commit()
+			err = model.CommitTx(tx)
 		}
 	}()
 	err = f(tx)
@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base32"
+	"encoding/gob"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// SessionStore はセッションの保存先です
+// sessions.Storeに加えて、サーバー側でセッションを無効にする操作を持ちます
+type SessionStore interface {
+	sessions.Store
+	// Revoke はユーザーの全てのセッションを無効にします
+	Revoke(userID int64) error
+	// Reset は全てのセッションを無効にします
+	Reset() error
+	// Renew は保存済みのセッションを削除し、次のSaveで新しいセッションIDを発行させます
+	Renew(session *sessions.Session) error
+}
+
+// sessionCacheSweepSize はキャッシュの掃除を行うセッション数です
+const sessionCacheSweepSize = 10000
+
+type sessionCache struct {
+	userID    int64
+	values    map[interface{}]interface{}
+	expiresAt time.Time
+	loadedAt  time.Time
+}
+
+// DBSessionStore はセッションをsessionテーブルに保存するSessionStoreです
+// Cookieには署名したセッションIDのみを保存し、セッションの内容はメモリ上にキャッシュします
+// キャッシュはプロセスごとのため、他のプロセスで無効にしたセッションはCacheTTLが経過するまで有効に見えます
+type DBSessionStore struct {
+	Codecs   []securecookie.Codec
+	Options  *sessions.Options
+	CacheTTL time.Duration
+
+	db    *sql.DB
+	mu    sync.RWMutex
+	cache map[string]*sessionCache
+}
+
+// NewDBSessionStore はDBSessionStoreを作成します
+// keyPairsはsecurecookie.CodecsFromPairsと同様で、先頭の鍵で署名し、全ての鍵で検証します
+// 鍵を入れ替える場合は新しい鍵を先頭に追加し、古い鍵は発行済みのセッションが期限切れになるまで残してください
+func NewDBSessionStore(db *sql.DB, keyPairs ...[]byte) *DBSessionStore {
+	s := &DBSessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		CacheTTL: 5 * time.Second,
+		db:       db,
+		cache:    make(map[string]*sessionCache),
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// MaxAge はセッションの有効期限を秒で設定します
+func (s *DBSessionStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+func (s *DBSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New はCookieのセッションIDからセッションを読み込みます
+// 検証できないCookieや無効になったセッションは新しいセッションとして扱います
+func (s *DBSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err = securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return session, nil
+	}
+	values, err := s.load(id)
+	if err != nil {
+		return session, err
+	}
+	if values != nil {
+		session.ID = id
+		session.Values = values
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+// Save はセッションを保存します
+// Options.MaxAgeが0以下の場合はセッションを削除します
+func (s *DBSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if err := s.delete(session.ID); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return errors.Wrap(err, "encode session failed")
+	}
+	userID, _ := session.Values["user_id"].(int64)
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := model.SaveSession(s.db, session.ID, userID, buf.Bytes(), expiresAt); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if len(s.cache) >= sessionCacheSweepSize {
+		s.sweepLocked(time.Now())
+	}
+	s.cache[session.ID] = &sessionCache{
+		userID:    userID,
+		values:    copyValues(session.Values),
+		expiresAt: expiresAt,
+		loadedAt:  time.Now(),
+	}
+	s.mu.Unlock()
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return errors.Wrap(err, "encode session id failed")
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew は保存済みのセッションを削除し、内容を空にして次のSaveで新しいセッションIDを発行させます
+// ログイン前のセッションIDを使い続けるとセッション固定攻撃を受けるため、ログイン時に呼んでください
+func (s *DBSessionStore) Renew(session *sessions.Session) error {
+	if err := s.delete(session.ID); err != nil {
+		return err
+	}
+	session.ID = ""
+	session.Values = make(map[interface{}]interface{})
+	session.IsNew = true
+	return nil
+}
+
+// delete は保存済みのセッションを削除します
+func (s *DBSessionStore) delete(id string) error {
+	if id == "" {
+		return nil
+	}
+	if err := model.DeleteSession(s.db, id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.cache, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// load はセッションの内容を返します。セッションが存在しない場合はnilを返します
+func (s *DBSessionStore) load(id string) (map[interface{}]interface{}, error) {
+	now := time.Now()
+	s.mu.RLock()
+	c, ok := s.cache[id]
+	s.mu.RUnlock()
+	if ok && now.Before(c.expiresAt) && now.Sub(c.loadedAt) < s.CacheTTL {
+		return copyValues(c.values), nil
+	}
+
+	ss, err := model.GetSession(s.db, id)
+	switch {
+	case err == sql.ErrNoRows:
+		s.mu.Lock()
+		delete(s.cache, id)
+		s.mu.Unlock()
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "get session failed. id:%s", id)
+	}
+	values := make(map[interface{}]interface{})
+	if err = gob.NewDecoder(bytes.NewReader(ss.Data)).Decode(&values); err != nil {
+		return nil, errors.Wrapf(err, "decode session failed. id:%s", id)
+	}
+	s.mu.Lock()
+	s.cache[id] = &sessionCache{
+		userID:    ss.UserID,
+		values:    values,
+		expiresAt: ss.ExpiresAt,
+		loadedAt:  now,
+	}
+	s.mu.Unlock()
+	return copyValues(values), nil
+}
+
+// sweepLocked はキャッシュから再読込が必要になったセッションを取り除きます
+func (s *DBSessionStore) sweepLocked(now time.Time) {
+	for id, c := range s.cache {
+		if !now.Before(c.expiresAt) || now.Sub(c.loadedAt) >= s.CacheTTL {
+			delete(s.cache, id)
+		}
+	}
+}
+
+func (s *DBSessionStore) Revoke(userID int64) error {
+	if err := model.DeleteSessionsByUserID(s.db, userID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, c := range s.cache {
+		if c.userID == userID {
+			delete(s.cache, id)
+		}
+	}
+	return nil
+}
+
+func (s *DBSessionStore) Reset() error {
+	if err := model.DeleteAllSessions(s.db); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cache = make(map[string]*sessionCache)
+	s.mu.Unlock()
+	return nil
+}
+
+func copyValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	v := make(map[interface{}]interface{}, len(values))
+	for k, val := range values {
+		v[k] = val
+	}
+	return v
+}
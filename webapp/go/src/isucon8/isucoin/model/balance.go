@@ -0,0 +1,119 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// InitialIsu は新規登録したユーザーが最初から保有している椅子の脚数の設定です
+	InitialIsu = "initial_isu"
+)
+
+type Balance struct {
+	// 保有している椅子の脚数
+	Isu int64 `json:"isu"`
+	// 売り注文中の椅子の脚数
+	IsuReserved int64 `json:"isu_reserved"`
+	// 新たに売り注文を出すことのできる椅子の脚数
+	IsuAvailable int64 `json:"isu_available"`
+	// いすこん銀行の確定済み残高
+	Credit int64 `json:"credit"`
+}
+
+func queryInt64(d QueryExecutor, query string, args ...interface{}) (int64, error) {
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var v sql.NullInt64
+	if rows.Next() {
+		if err = rows.Scan(&v); err != nil {
+			return 0, err
+		}
+	}
+	return v.Int64, rows.Err()
+}
+
+// GetIsuHolding はユーザーが保有している椅子の脚数を返します
+func GetIsuHolding(d QueryExecutor, userID int64) (int64, error) {
+	return queryInt64(d, `SELECT SUM(amount) FROM isu_ledger WHERE user_id = ?`, userID)
+}
+
+// getIsuInSellOrders は未成立の売り注文の脚数を返します
+func getIsuInSellOrders(d QueryExecutor, userID int64) (int64, error) {
+	return queryInt64(d, `SELECT SUM(amount - filled_amount) FROM orders WHERE user_id = ? AND type = ? AND closed_at IS NULL`, userID, OrderTypeSell)
+}
+
+// getAvailableIsu は新たに売り注文を出すことのできる椅子の脚数を返します
+func getAvailableIsu(d QueryExecutor, userID int64) (int64, error) {
+	holding, err := GetIsuHolding(d, userID)
+	if err != nil {
+		return 0, errors.Wrap(err, "GetIsuHolding failed")
+	}
+	reserved, err := getIsuInSellOrders(d, userID)
+	if err != nil {
+		return 0, errors.Wrap(err, "getIsuInSellOrders failed")
+	}
+	return holding - reserved, nil
+}
+
+// addIsuLedger は取引による椅子の増減を記録します
+func addIsuLedger(tx *sql.Tx, order *Order, tradeID, amount int64) error {
+	if order.Type == OrderTypeSell {
+		amount *= -1
+	}
+	_, err := tx.Exec(`INSERT INTO isu_ledger (user_id, order_id, trade_id, amount, created_at) VALUES (?, ?, ?, ?, NOW(6))`, order.UserID, order.ID, tradeID, amount)
+	return err
+}
+
+// getInitialIsu は設定から新規登録したユーザーが最初から保有している椅子の脚数を返します。未設定の場合は0です
+func getInitialIsu(d QueryExecutor) (int64, error) {
+	val, err := GetSetting(d, InitialIsu)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && val == ""):
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrapf(err, "getSetting failed. %s", InitialIsu)
+	}
+	amount, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || amount < 0 {
+		return 0, errors.Errorf("invalid initial isu. %s:%s", InitialIsu, val)
+	}
+	return amount, nil
+}
+
+// addInitialIsu は新規登録したユーザーに最初から保有している椅子を記録します
+func addInitialIsu(tx *sql.Tx, userID int64) error {
+	amount, err := getInitialIsu(tx)
+	if err != nil || amount == 0 {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO isu_ledger (user_id, order_id, trade_id, amount, created_at) VALUES (?, 0, 0, ?, NOW(6))`, userID, amount)
+	return err
+}
+
+func GetBalance(d QueryExecutor, user *User) (*Balance, error) {
+	var (
+		b   Balance
+		err error
+	)
+	if b.Isu, err = GetIsuHolding(d, user.ID); err != nil {
+		return nil, errors.Wrap(err, "GetIsuHolding failed")
+	}
+	if b.IsuReserved, err = getIsuInSellOrders(d, user.ID); err != nil {
+		return nil, errors.Wrap(err, "getIsuInSellOrders failed")
+	}
+	b.IsuAvailable = b.Isu - b.IsuReserved
+	bank, err := Isubank(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "newIsubank failed")
+	}
+	if b.Credit, err = bank.Credit(user.BankID); err != nil {
+		return nil, errors.Wrap(err, "isubank credit failed")
+	}
+	return &b, nil
+}
@@ -0,0 +1,191 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ロウソク足の足の長さ
+const (
+	CandlestickBySec   = "sec"
+	CandlestickByMin   = "min"
+	CandlestickBy5Min  = "5min"
+	CandlestickBy15Min = "15min"
+	CandlestickByHour  = "hour"
+	CandlestickByDay   = "day"
+)
+
+// candlestickMaxBars は1回に取得できる足の数の上限です
+const candlestickMaxBars = 1000
+
+type candlestickResolution struct {
+	name     string
+	duration time.Duration
+	// truncate は時刻を足の開始時刻に丸めます
+	truncate func(t time.Time) time.Time
+	// bucket はtrade.created_atを足の開始時刻に丸めるSQLの式です
+	bucket string
+}
+
+var candlestickResolutions = []candlestickResolution{
+	{
+		name:     CandlestickBySec,
+		duration: time.Second,
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+		},
+		bucket: "DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')",
+	},
+	{
+		name:     CandlestickByMin,
+		duration: time.Minute,
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		},
+		bucket: "DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:00')",
+	},
+	{
+		name:     CandlestickBy5Min,
+		duration: 5 * time.Minute,
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()-t.Minute()%5, 0, 0, t.Location())
+		},
+		bucket: "DATE_FORMAT(created_at, '%Y-%m-%d %H:00:00') + INTERVAL (MINUTE(created_at) DIV 5 * 5) MINUTE",
+	},
+	{
+		name:     CandlestickBy15Min,
+		duration: 15 * time.Minute,
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()-t.Minute()%15, 0, 0, t.Location())
+		},
+		bucket: "DATE_FORMAT(created_at, '%Y-%m-%d %H:00:00') + INTERVAL (MINUTE(created_at) DIV 15 * 15) MINUTE",
+	},
+	{
+		name:     CandlestickByHour,
+		duration: time.Hour,
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		},
+		bucket: "DATE_FORMAT(created_at, '%Y-%m-%d %H:00:00')",
+	},
+	{
+		name:     CandlestickByDay,
+		duration: 24 * time.Hour,
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		bucket: "DATE(created_at)",
+	},
+}
+
+// candlestickColumns は足の列です。VWAPは売買代金を出来高で割って求めます
+const candlestickColumns = "t, open, close, high, low, volume, trade_count, turnover / volume"
+
+func getCandlestickResolution(name string) (candlestickResolution, bool) {
+	for _, r := range candlestickResolutions {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return candlestickResolution{}, false
+}
+
+// GetCandlestickData はmt以降のロウソク足を返します
+func GetCandlestickData(d QueryExecutor, mt time.Time, resolution string) ([]*CandlestickData, error) {
+	if _, ok := getCandlestickResolution(resolution); !ok {
+		return nil, errors.Errorf("unknown candlestick resolution: %s", resolution)
+	}
+	return scanCandlestickDatas(d.Query("SELECT "+candlestickColumns+" FROM candlestick WHERE resolution = ? AND t >= ? ORDER BY t", resolution, mt))
+}
+
+// GetCandlestickDataRange はfrom以降to以前に開始した足を返します
+// toが未指定(ゼロ値)の場合は現在時刻、fromが未指定の場合はtoから300本分前を起点とします
+func GetCandlestickDataRange(d QueryExecutor, resolution string, from, to time.Time) ([]*CandlestickData, error) {
+	r, ok := getCandlestickResolution(resolution)
+	if !ok {
+		return nil, ErrParameterInvalid
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-300 * r.duration)
+	}
+	from = r.truncate(from)
+	if to.Before(from) || to.Sub(from)/r.duration >= candlestickMaxBars {
+		return nil, ErrParameterInvalid
+	}
+	return scanCandlestickDatas(d.Query("SELECT "+candlestickColumns+" FROM candlestick WHERE resolution = ? AND t >= ? AND t <= ? ORDER BY t", resolution, from, to))
+}
+
+// addCandlestick は取引を各足に反映します
+// 始値・終値は足に含まれる取引のうちidが最小・最大のものの価格です
+func addCandlestick(d QueryExecutor, tradeID int64) error {
+	for _, r := range candlestickResolutions {
+		// open, closeは更新前のopen_trade_id, close_trade_idと比較するため先に更新する
+		query := `
+			INSERT INTO candlestick (resolution, t, open, close, high, low, volume, trade_count, turnover, open_trade_id, close_trade_id)
+			SELECT ?, ` + r.bucket + `, price, price, price, price, amount, 1, price * amount, id, id FROM trade WHERE id = ?
+			ON DUPLICATE KEY UPDATE
+				open = IF(VALUES(open_trade_id) < open_trade_id, VALUES(open), open),
+				close = IF(VALUES(close_trade_id) > close_trade_id, VALUES(close), close),
+				high = GREATEST(high, VALUES(high)),
+				low = LEAST(low, VALUES(low)),
+				volume = volume + VALUES(volume),
+				trade_count = trade_count + VALUES(trade_count),
+				turnover = turnover + VALUES(turnover),
+				open_trade_id = LEAST(open_trade_id, VALUES(open_trade_id)),
+				close_trade_id = GREATEST(close_trade_id, VALUES(close_trade_id))`
+		if _, err := d.Exec(query, r.name, tradeID); err != nil {
+			return errors.Wrapf(err, "upsert candlestick failed. resolution:%s, trade_id:%d", r.name, tradeID)
+		}
+	}
+	return nil
+}
+
+// RebuildCandlesticks はsince以降の取引を含む足をtradeから作り直します
+func RebuildCandlesticks(d QueryExecutor, since time.Time) error {
+	for _, r := range candlestickResolutions {
+		from := r.truncate(since)
+		if _, err := d.Exec(`DELETE FROM candlestick WHERE resolution = ? AND t >= ?`, r.name, from); err != nil {
+			return errors.Wrapf(err, "delete candlestick failed. resolution:%s", r.name)
+		}
+		query := `
+			INSERT INTO candlestick (resolution, t, open, close, high, low, volume, trade_count, turnover, open_trade_id, close_trade_id)
+			SELECT ?, m.t, a.price, b.price, m.h, m.l, m.v, m.n, m.turnover, m.min_id, m.max_id
+			FROM (
+				SELECT
+					` + r.bucket + ` AS t,
+					MIN(id) AS min_id,
+					MAX(id) AS max_id,
+					MAX(price) AS h,
+					MIN(price) AS l,
+					SUM(amount) AS v,
+					COUNT(*) AS n,
+					SUM(price * amount) AS turnover
+				FROM trade
+				WHERE created_at >= ?
+				GROUP BY t
+			) m
+			JOIN trade a ON a.id = m.min_id
+			JOIN trade b ON b.id = m.max_id`
+		if _, err := d.Exec(query, r.name, from); err != nil {
+			return errors.Wrapf(err, "rebuild candlestick failed. resolution:%s", r.name)
+		}
+	}
+	return nil
+}
+
+// InitCandlesticks はsince以降の足を作り直します
+// 初期データの足が作られていない場合は全ての足を作り直します
+func InitCandlesticks(d QueryExecutor, since time.Time) error {
+	count, err := queryInt64(d, "SELECT COUNT(*) FROM candlestick")
+	if err != nil {
+		return errors.Wrap(err, "count candlestick failed")
+	}
+	if count == 0 {
+		since = time.Unix(0, 0)
+	}
+	return RebuildCandlesticks(d, since)
+}
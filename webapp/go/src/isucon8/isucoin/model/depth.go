@@ -0,0 +1,82 @@
+package model
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// orderBookMaxDepth は板情報として返す価格と取引の最大件数です
+const orderBookMaxDepth = 100
+
+// PriceLevel は同一価格の未成立注文を集計したものです
+type PriceLevel struct {
+	Price  int64 `json:"price"`
+	Amount int64 `json:"amount"`
+	Orders int   `json:"orders"`
+}
+
+type OrderBook struct {
+	Asks   []*PriceLevel `json:"asks"`
+	Bids   []*PriceLevel `json:"bids"`
+	Trades []*Trade      `json:"trades"`
+}
+
+// orderBookCache は板が変わるまで板情報を使い回します
+// トレードの成立は必ず板を変え、板への反映はコミット後に行うため、直近の取引も合わせてキャッシュします
+var orderBookCache struct {
+	sync.Mutex
+	version uint64
+	ob      *OrderBook
+}
+
+// GetOrderBook は売り・買いそれぞれ最良の価格からdepth件の集計と、直近depth件の取引を返します
+func GetOrderBook(d QueryExecutor, depth int) (*OrderBook, error) {
+	if depth <= 0 || depth > orderBookMaxDepth {
+		return nil, ErrParameterInvalid
+	}
+	ob, err := getOrderBookCache(d)
+	if err != nil {
+		return nil, err
+	}
+	return &OrderBook{
+		Asks:   headPriceLevels(ob.Asks, depth),
+		Bids:   headPriceLevels(ob.Bids, depth),
+		Trades: headTrades(ob.Trades, depth),
+	}, nil
+}
+
+func getOrderBookCache(d QueryExecutor) (*OrderBook, error) {
+	orderBookCache.Lock()
+	defer orderBookCache.Unlock()
+	before := book.currentVersion()
+	if orderBookCache.ob != nil && orderBookCache.version == before {
+		return orderBookCache.ob, nil
+	}
+	trades, err := scanTrades(d.Query("SELECT * FROM trade ORDER BY id DESC LIMIT ?", orderBookMaxDepth))
+	if err != nil {
+		return nil, errors.Wrap(err, "find latest trades failed")
+	}
+	asks, bids, version := book.depth(orderBookMaxDepth)
+	ob := &OrderBook{Asks: asks, Bids: bids, Trades: trades}
+	// 取引の取得中に板が変わった場合は取引と板がずれている可能性があるためキャッシュしない
+	if version == before {
+		orderBookCache.version = version
+		orderBookCache.ob = ob
+	}
+	return ob, nil
+}
+
+func headPriceLevels(levels []*PriceLevel, n int) []*PriceLevel {
+	if len(levels) > n {
+		return levels[:n]
+	}
+	return levels
+}
+
+func headTrades(trades []*Trade, n int) []*Trade {
+	if len(trades) > n {
+		return trades[:n]
+	}
+	return trades
+}
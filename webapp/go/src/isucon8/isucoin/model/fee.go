@@ -0,0 +1,79 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// 手数料の設定
+const (
+	// MakerFeeRate は板に載っていた注文(メイカー)の手数料率です。単位は0.01%です
+	MakerFeeRate = "maker_fee_rate"
+	// TakerFeeRate は板の注文と取引した注文(テイカー)の手数料率です。単位は0.01%です
+	TakerFeeRate = "taker_fee_rate"
+	// FeeBankID は手数料を受け取る取引所のいすこん銀行のアカウントです
+	FeeBankID = "fee_bank_id"
+)
+
+// FeeSchedule は取引手数料の設定です
+// BankIDが設定されていない場合は手数料を取りません
+type FeeSchedule struct {
+	MakerRate int64
+	TakerRate int64
+	BankID    string
+}
+
+// GetFeeSchedule は設定から手数料の設定を返します。未設定の項目は0として扱います
+func GetFeeSchedule(d QueryExecutor) (*FeeSchedule, error) {
+	s := &FeeSchedule{}
+	for k, v := range map[string]*int64{MakerFeeRate: &s.MakerRate, TakerFeeRate: &s.TakerRate} {
+		val, err := GetSetting(d, k)
+		switch {
+		case err == sql.ErrNoRows || (err == nil && val == ""):
+			continue
+		case err != nil:
+			return nil, errors.Wrapf(err, "getSetting failed. %s", k)
+		}
+		if *v, err = strconv.ParseInt(val, 10, 64); err != nil || *v < 0 || *v >= 10000 {
+			return nil, errors.Errorf("invalid fee rate. %s:%s", k, val)
+		}
+	}
+	id, err := GetSetting(d, FeeBankID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "getSetting failed. %s", FeeBankID)
+	}
+	s.BankID = id
+	return s, nil
+}
+
+// fee は取引金額totalに対する手数料を返します。1未満は切り捨てます
+func (s *FeeSchedule) fee(total int64, maker bool) int64 {
+	if s.BankID == "" {
+		return 0
+	}
+	rate := s.TakerRate
+	if maker {
+		rate = s.MakerRate
+	}
+	return total * rate / 10000
+}
+
+// setFees は取引する各注文の手数料を設定します
+// 取引する注文のうち先に注文されて板に載っていた方をメイカー、後から注文された方をテイカーとします
+func (s *FeeSchedule) setFees(taker *tradeFill, makers []tradeFill, price int64) {
+	taker.fee = s.fee(taker.amount*price, false)
+	for i := range makers {
+		makers[i].fee = s.fee(makers[i].amount*price, orderBefore(makers[i].order, taker.order))
+	}
+}
+
+// maxFee は注文がメイカー、テイカーのどちらになっても足りる手数料を返します
+func (s *FeeSchedule) maxFee(total int64) int64 {
+	maker, taker := s.fee(total, true), s.fee(total, false)
+	if maker > taker {
+		return maker
+	}
+	return taker
+}
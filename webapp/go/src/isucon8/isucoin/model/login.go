@@ -0,0 +1,154 @@
+package model
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// ログイン失敗によるロックの設定
+// LoginFailureWindow 秒の間に上限回数失敗すると LoginLockoutDuration 秒の間ログインできなくなります
+var (
+	LoginFailureWindow   int64 = 600
+	LoginLockoutDuration int64 = 600
+
+	// LoginFailureLimit はbank_idごとの失敗回数の上限です
+	LoginFailureLimit int64 = 5
+	// LoginFailureIPLimit はIPアドレスごとの失敗回数の上限です。0の場合はIPアドレスでの制限を行いません
+	LoginFailureIPLimit int64 = 0
+)
+
+type loginKey struct {
+	key   string
+	limit int64
+}
+
+func loginKeys(bankID, ip string) []loginKey {
+	keys := []loginKey{{"bank_id:" + bankID, LoginFailureLimit}}
+	if LoginFailureIPLimit > 0 && ip != "" {
+		keys = append(keys, loginKey{"ip:" + ip, LoginFailureIPLimit})
+	}
+	return keys
+}
+
+// LoginAttempt はロックされていないことを確認して開始したログインの試行です
+// 試行は開始時に失敗として記録しているため、結果に応じてFail, Succeed, Cancelのいずれかを呼んでください
+type LoginAttempt struct {
+	tag        string
+	bankID     string
+	ip         string
+	failureIDs []int64
+}
+
+// BeginLoginAttempt はbank_idとIPアドレスがロックされていないことを確認し、試行をログイン失敗として記録します
+// 確認と記録は1つのトランザクションでキーごとに直列に行うため、同時に試行しても上限回数を超えて試行できません
+// ロックされている場合、または失敗回数が上限に達していてロックした場合はErrTooManyFailuresを返します
+func BeginLoginAttempt(db *sql.DB, tag, bankID, ip string) (*LoginAttempt, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "begin transaction failed")
+	}
+	keys := loginKeys(bankID, ip)
+	for _, k := range keys {
+		locked, err := lockLoginKey(tx, k)
+		if err != nil {
+			RollbackTx(tx)
+			return nil, err
+		}
+		if !locked {
+			continue
+		}
+		// 上限に達したことによるロックは残す
+		if err = CommitTx(tx); err != nil {
+			return nil, errors.Wrap(err, "commit failed")
+		}
+		sendErrorLog(db, tag+".error", map[string]interface{}{
+			"bank_id": bankID,
+			"ip":      ip,
+			"error":   ErrTooManyFailures.Error(),
+		})
+		return nil, ErrTooManyFailures
+	}
+	a := &LoginAttempt{tag: tag, bankID: bankID, ip: ip}
+	for _, k := range keys {
+		res, err := tx.Exec(`INSERT INTO login_failure (login_key, created_at) VALUES (?, NOW(6))`, k.key)
+		if err != nil {
+			RollbackTx(tx)
+			return nil, errors.Wrapf(err, "insert login_failure failed. key:%s", k.key)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			RollbackTx(tx)
+			return nil, errors.Wrap(err, "lastInsertID for login_failure")
+		}
+		a.failureIDs = append(a.failureIDs, id)
+	}
+	if err = CommitTx(tx); err != nil {
+		return nil, errors.Wrap(err, "commit failed")
+	}
+	return a, nil
+}
+
+// lockLoginKey はキーの行を排他ロックし、ロック中または失敗回数が上限に達している場合にtrueを返します
+// 失敗回数が上限に達している場合は LoginLockoutDuration 秒の間ロックします
+func lockLoginKey(tx *sql.Tx, k loginKey) (bool, error) {
+	// 同じキーの試行を直列にするため、ロックの行が無ければ作成して排他ロックを取る
+	if _, err := tx.Exec(`INSERT INTO login_lock (login_key, locked_until) VALUES (?, NOW(6)) ON DUPLICATE KEY UPDATE login_key = VALUES(login_key)`, k.key); err != nil {
+		return false, errors.Wrapf(err, "insert login_lock failed. key:%s", k.key)
+	}
+	locked, err := queryInt64(tx, "SELECT COUNT(*) FROM login_lock WHERE login_key = ? AND locked_until > NOW(6) FOR UPDATE", k.key)
+	if err != nil {
+		return false, errors.Wrapf(err, "find login_lock failed. key:%s", k.key)
+	}
+	if locked > 0 {
+		return true, nil
+	}
+	if _, err = tx.Exec(`DELETE FROM login_failure WHERE login_key = ? AND created_at <= NOW(6) - INTERVAL ? SECOND`, k.key, LoginFailureWindow); err != nil {
+		return false, errors.Wrapf(err, "delete login_failure failed. key:%s", k.key)
+	}
+	count, err := queryInt64(tx, "SELECT COUNT(*) FROM login_failure WHERE login_key = ?", k.key)
+	if err != nil {
+		return false, errors.Wrapf(err, "count login_failure failed. key:%s", k.key)
+	}
+	if count < k.limit {
+		return false, nil
+	}
+	if _, err = tx.Exec(`UPDATE login_lock SET locked_until = NOW(6) + INTERVAL ? SECOND WHERE login_key = ?`, LoginLockoutDuration, k.key); err != nil {
+		return false, errors.Wrapf(err, "update login_lock failed. key:%s", k.key)
+	}
+	return true, nil
+}
+
+// Fail はログインの失敗をログに送信します。失敗回数は開始時に記録済みです
+func (a *LoginAttempt) Fail(d QueryExecutor, cause error) {
+	sendErrorLog(d, a.tag+".error", map[string]interface{}{
+		"bank_id": a.bankID,
+		"ip":      a.ip,
+		"error":   cause.Error(),
+	})
+}
+
+// Succeed はログインに成功したbank_idの失敗回数とロックを解除し、この試行の記録を取り消します
+// IPアドレスの失敗回数は他のユーザーでログインすることで解除できないよう、この試行の分のみ取り消します
+func (a *LoginAttempt) Succeed(d QueryExecutor) error {
+	key := "bank_id:" + a.bankID
+	if _, err := d.Exec(`DELETE FROM login_failure WHERE login_key = ?`, key); err != nil {
+		return errors.Wrapf(err, "delete login_failure failed. key:%s", key)
+	}
+	if _, err := d.Exec(`DELETE FROM login_lock WHERE login_key = ?`, key); err != nil {
+		return errors.Wrapf(err, "delete login_lock failed. key:%s", key)
+	}
+	return a.Cancel(d)
+}
+
+// Cancel はログイン失敗ではなかった試行の記録を取り消します
+func (a *LoginAttempt) Cancel(d QueryExecutor) error {
+	if len(a.failureIDs) == 0 {
+		return nil
+	}
+	query, args := inQuery("DELETE FROM login_failure WHERE id IN (%s)", a.failureIDs)
+	if _, err := d.Exec(query, args...); err != nil {
+		return errors.Wrap(err, "delete login_failure failed")
+	}
+	return nil
+}
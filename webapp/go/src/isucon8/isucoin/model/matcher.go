@@ -0,0 +1,155 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+)
+
+// Matcher はトレード処理を単一のgoroutineで直列に実行します
+// NewMatcherで初期化し、Runを別goroutineで起動してください
+type Matcher struct {
+	db *sql.DB
+	// run は1回分のトレード処理です。受け付けたIOC/FOK注文を受け取ります
+	run  func(immediate []int64)
+	kick chan struct{}
+	quit chan struct{}
+	done chan struct{}
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	immediate []int64
+	requested uint64
+	finished  uint64
+	stopped   bool
+}
+
+func NewMatcher(db *sql.DB) *Matcher {
+	m := &Matcher{
+		db:   db,
+		kick: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	m.run = m.process
+	return m
+}
+
+// Trigger はトレード処理を要求します
+// 処理待ちの要求がある場合はまとめて1回の処理になるため呼び出し側はブロックしません
+func (m *Matcher) Trigger() {
+	m.mu.Lock()
+	m.requested++
+	m.mu.Unlock()
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Submit はIOC/FOK注文の即時処理を要求します
+// 要求はまとめられず、受け付けた順に処理されます
+func (m *Matcher) Submit(orderID int64) {
+	m.mu.Lock()
+	m.immediate = append(m.immediate, orderID)
+	m.requested++
+	m.mu.Unlock()
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run はShutdownされるまでトレード処理を行います
+func (m *Matcher) Run() {
+	defer func() {
+		m.mu.Lock()
+		m.stopped = true
+		m.cond.Broadcast()
+		m.mu.Unlock()
+		close(m.done)
+	}()
+	for {
+		quit := false
+		select {
+		case <-m.quit:
+			quit = true
+		case <-m.kick:
+		}
+		m.mu.Lock()
+		target := m.requested
+		immediate := m.immediate
+		m.immediate = nil
+		pending := m.finished < target
+		m.mu.Unlock()
+
+		if pending {
+			m.run(immediate)
+			m.mu.Lock()
+			m.finished = target
+			m.cond.Broadcast()
+			m.mu.Unlock()
+		}
+		if quit {
+			// Shutdownまでに要求された処理は終えてから終了する
+			return
+		}
+	}
+}
+
+// process はIOC/FOK注文の処理、板のトレード、逆指値注文の発動を行います
+func (m *Matcher) process(immediate []int64) {
+	for _, orderID := range immediate {
+		if err := RunImmediateOrder(m.db, orderID); err != nil {
+			log.Printf("runImmediateOrder err:%s", err)
+		}
+	}
+	if err := RunTrade(m.db); err != nil {
+		// トレードに失敗しても次の要求は処理する
+		log.Printf("runTrade err:%s", err)
+	}
+	// 逆指値注文の発動による取引で更に発動する注文があるため、発動しなくなるまで繰り返す
+	for {
+		n, err := RunStopOrders(m.db)
+		if err != nil {
+			log.Printf("runStopOrders err:%s", err)
+		}
+		if n == 0 {
+			break
+		}
+		if err = RunTrade(m.db); err != nil {
+			log.Printf("runTrade err:%s", err)
+		}
+	}
+}
+
+// Drain は呼び出し時点までに要求されたトレード処理の完了を待ちます
+func (m *Matcher) Drain() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target := m.requested
+	for m.finished < target && !m.stopped {
+		m.cond.Wait()
+	}
+}
+
+// Shutdown は要求済みのトレード処理の完了を待ってRunを終了させます
+func (m *Matcher) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.stopped {
+		select {
+		case <-m.quit:
+		default:
+			close(m.quit)
+		}
+	}
+	m.mu.Unlock()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
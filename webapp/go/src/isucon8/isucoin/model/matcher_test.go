@@ -0,0 +1,134 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMatcher はトレード処理の代わりに受け取ったIOC/FOK注文を記録するMatcherを返します
+// releaseが閉じられるまで各処理をブロックします
+func testMatcher(release <-chan struct{}) (*Matcher, func() ([]int64, int)) {
+	m := NewMatcher(nil)
+	var (
+		mu        sync.Mutex
+		processed []int64
+		runs      int
+	)
+	m.run = func(immediate []int64) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, immediate...)
+		runs++
+	}
+	return m, func() ([]int64, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int64{}, processed...), runs
+	}
+}
+
+func TestMatcherDrainWaitsForQueuedRequests(t *testing.T) {
+	release := make(chan struct{})
+	m, result := testMatcher(release)
+	go m.Run()
+	defer m.Shutdown(context.Background())
+
+	m.Submit(1)
+	m.Trigger()
+	m.Submit(2)
+	m.Trigger()
+
+	drained := make(chan struct{})
+	go func() {
+		m.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("Drain returned before queued requests are processed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return")
+	}
+	processed, _ := result()
+	if want := []int64{1, 2}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed: got %v, want %v", processed, want)
+	}
+}
+
+func TestMatcherCoalescesTriggers(t *testing.T) {
+	release := make(chan struct{})
+	m, result := testMatcher(release)
+	go m.Run()
+	defer m.Shutdown(context.Background())
+
+	// 1回目の処理中に要求されたトリガーは次の1回の処理にまとめる
+	m.Trigger()
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		m.Trigger()
+	}
+	close(release)
+	m.Drain()
+	if _, runs := result(); runs != 2 {
+		t.Errorf("runs: got %d, want 2", runs)
+	}
+}
+
+func TestMatcherShutdownFlushesQueuedRequests(t *testing.T) {
+	release := make(chan struct{})
+	m, result := testMatcher(release)
+	go m.Run()
+
+	m.Trigger()
+	time.Sleep(20 * time.Millisecond)
+	// 処理中に要求されたものはShutdownまでに処理する
+	m.Submit(3)
+	m.Trigger()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Shutdown(context.Background())
+	}()
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown failed. err:%s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	processed, runs := result()
+	if want := []int64{3}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed: got %v, want %v", processed, want)
+	}
+	if runs != 2 {
+		t.Errorf("runs: got %d, want 2", runs)
+	}
+	// 終了後のDrainはブロックしない
+	m.Trigger()
+	m.Drain()
+}
+
+func TestMatcherShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	m, _ := testMatcher(release)
+	go m.Run()
+
+	m.Trigger()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
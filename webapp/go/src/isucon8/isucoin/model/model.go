@@ -2,6 +2,8 @@ package model
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -13,8 +15,10 @@ var (
 	ErrOrderNotFound      = errors.New("order not found")
 	ErrOrderAlreadyClosed = errors.New("order is already closed")
 	ErrCreditInsufficient = errors.New("銀行の残高が足りません")
+	ErrIsuInsufficient    = errors.New("椅子の保有数が足りません")
 	ErrParameterInvalid   = errors.New("parameter invalid")
 	ErrNoOrderForTrade    = errors.New("no order for trade")
+	ErrTooManyFailures    = errors.New("too many failures")
 )
 
 type QueryExecutor interface {
@@ -22,15 +26,49 @@ type QueryExecutor interface {
 	Query(string, ...interface{}) (*sql.Rows, error)
 }
 
+// CommitTx はトランザクションをコミットし、トランザクション中の板の変更とイベントを反映します
+func CommitTx(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		book.discard(tx)
+		stream.discard(tx)
+		return err
+	}
+	book.commit(tx)
+	stream.commit(tx)
+	return nil
+}
+
+// RollbackTx はトランザクションをロールバックし、トランザクション中の板の変更とイベントを破棄します
+func RollbackTx(tx *sql.Tx) error {
+	book.discard(tx)
+	stream.discard(tx)
+	return tx.Rollback()
+}
+
 func InitBenchmark(d QueryExecutor) error {
 	for _, q := range []string{
 		"DELETE FROM orders WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM stop_orders WHERE created_at >= '2018-10-16 10:00:00'",
 		"DELETE FROM trade WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM order_fill WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM isu_ledger WHERE created_at >= '2018-10-16 10:00:00'",
 		"DELETE FROM user WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM login_failure",
+		"DELETE FROM login_lock",
+		"DELETE FROM log_outbox",
 	} {
 		if _, err := d.Exec(q); err != nil {
-			return errors.Wrapf(err, "query exec failed[%d]", q)
+			return errors.Wrapf(err, "query exec failed[%s]", q)
 		}
 	}
 	return nil
 }
+
+// inQuery はqueryの%sをidsの数だけのプレースホルダに置き換え、引数と共に返します
+func inQuery(query string, ids []int64) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return fmt.Sprintf(query, strings.Repeat(",?", len(ids))[1:]), args
+}
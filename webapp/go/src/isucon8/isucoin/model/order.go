@@ -2,6 +2,7 @@ package model
 
 import (
 	"database/sql"
+	"encoding/json"
 	"isucon8/isubank"
 	"time"
 
@@ -11,28 +12,179 @@ import (
 const (
 	OrderTypeBuy  = "buy"
 	OrderTypeSell = "sell"
+
+	// 指値注文
+	OrderTypeLimit = "limit"
+	// 成行注文
+	OrderTypeMarket = "market"
+
+	// 取り消されるまで有効
+	TimeInForceGTC = "GTC"
+	// 即時に成立しなかった分は取り消す
+	TimeInForceIOC = "IOC"
+	// 全て即時に成立しない場合は取り消す
+	TimeInForceFOK = "FOK"
+
+	CancelReasonCanceled      = "canceled"
+	CancelReasonReserveFailed = "reserve_failed"
+	CancelReasonIOC           = "immediate_or_cancel"
+	CancelReasonFOK           = "fill_or_kill"
+	CancelReasonExpired       = "expired"
+	CancelReasonAmended       = "amended"
+)
+
+// 注文の状態
+const (
+	// 未成立の脚数が残っている注文
+	OrderStatusOpen = "open"
+	// 全て成立した注文
+	OrderStatusTraded = "traded"
+	// 成立しきらずに取り消された注文。取り消された理由はclose_reasonに記録します
+	OrderStatusCanceled = "canceled"
 )
 
+// OrderFilterStatusAll はOrderFilterで取り消された注文を含む全ての注文を返すためのStatusです
+const OrderFilterStatusAll = "all"
+
+// OrderFilter は注文一覧の絞り込みとページングの条件です
+// Statusが未指定の場合は取引が成立した注文と未成立の注文を返し、一部も成立せずに取り消された注文は含みません
+type OrderFilter struct {
+	Status string
+	Type   string
+	From   *time.Time
+	To     *time.Time
+	// Cursor を指定するとこのidより後の注文を返します
+	Cursor int64
+	// Limit が0の場合は全件を返します
+	Limit int
+}
+
+// OrderOption は注文の執行条件です
+// ゼロ値は指値のGTC注文になります
+type OrderOption struct {
+	OrderType   string `json:"order_type"`
+	TimeInForce string `json:"time_in_force"`
+	// ExpireAt を指定したGTC注文はその時刻に自動的に取り消されます
+	ExpireAt *time.Time `json:"expire_at"`
+}
+
 //go:generate scanner
 type Order struct {
-	ID        int64      `json:"id"`
-	Type      string     `json:"type"`
-	UserID    int64      `json:"user_id"`
-	Amount    int64      `json:"amount"`
-	Price     int64      `json:"price"`
-	ClosedAt  *time.Time `json:"closed_at"`
-	TradeID   int64      `json:"trade_id,omitempty"`
-	CreatedAt time.Time  `json:"created_at"`
-	User      *User      `json:"user,omitempty"`
-	Trade     *Trade     `json:"trade,omitempty"`
+	ID           int64        `json:"id"`
+	Type         string       `json:"type"`
+	UserID       int64        `json:"user_id"`
+	Amount       int64        `json:"amount"`
+	Price        int64        `json:"price"`
+	OrderType    string       `json:"order_type"`
+	TimeInForce  string       `json:"time_in_force"`
+	ExpireAt     *time.Time   `json:"expire_at"`
+	FilledAmount int64        `json:"filled_amount"`
+	Fee          int64        `json:"fee"`
+	Status       string       `json:"status"`
+	CloseReason  string       `json:"close_reason,omitempty"`
+	ClosedAt     *time.Time   `json:"closed_at"`
+	TradeID      int64        `json:"trade_id,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	User         *User        `json:"user,omitempty"`
+	Trade        *Trade       `json:"trade,omitempty"`
+	Fills        []*OrderFill `json:"fills,omitempty"`
+}
+
+//go:generate scanner
+type OrderFill struct {
+	ID        int64     `json:"-"`
+	OrderID   int64     `json:"order_id"`
+	TradeID   int64     `json:"trade_id"`
+	Amount    int64     `json:"amount"`
+	Fee       int64     `json:"fee"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IsImmediate は板に載らず即時に処理される注文かどうかを返します
+func (o *Order) IsImmediate() bool {
+	return o.TimeInForce != TimeInForceGTC
 }
 
-func GetOrdersByUserID(d QueryExecutor, userID int64) ([]*Order, error) {
-	return scanOrders(d.Query("SELECT * FROM orders WHERE user_id = ? AND (closed_at IS NULL OR trade_id IS NOT NULL) ORDER BY created_at ASC", userID))
+// RemainingAmount は未成立の脚数を返します
+func (o *Order) RemainingAmount() int64 {
+	return o.Amount - o.FilledAmount
+}
+
+func (o *Order) MarshalJSON() ([]byte, error) {
+	type order Order
+	return json.Marshal(struct {
+		*order
+		RemainingAmount int64 `json:"remaining_amount"`
+	}{
+		order:           (*order)(o),
+		RemainingAmount: o.RemainingAmount(),
+	})
+}
+
+// GetOrdersByUserID は条件に合うユーザーの注文をid順に返します
+// Limitを指定した場合は続きの注文があれば次のCursorも返します
+func GetOrdersByUserID(d QueryExecutor, userID int64, f OrderFilter) ([]*Order, int64, error) {
+	query := "SELECT * FROM orders WHERE user_id = ?"
+	args := []interface{}{userID}
+	switch f.Status {
+	case "":
+		query += " AND (status <> ? OR filled_amount > 0)"
+		args = append(args, OrderStatusCanceled)
+	case OrderFilterStatusAll:
+	case OrderStatusOpen, OrderStatusTraded, OrderStatusCanceled:
+		query += " AND status = ?"
+		args = append(args, f.Status)
+	default:
+		return nil, 0, ErrParameterInvalid
+	}
+	switch f.Type {
+	case "":
+	case OrderTypeBuy, OrderTypeSell:
+		query += " AND type = ?"
+		args = append(args, f.Type)
+	default:
+		return nil, 0, ErrParameterInvalid
+	}
+	if f.From != nil {
+		query += " AND created_at >= ?"
+		args = append(args, *f.From)
+	}
+	if f.To != nil {
+		query += " AND created_at < ?"
+		args = append(args, *f.To)
+	}
+	if f.Cursor > 0 {
+		query += " AND id > ?"
+		args = append(args, f.Cursor)
+	}
+	query += " ORDER BY id ASC"
+	if f.Limit < 0 {
+		return nil, 0, ErrParameterInvalid
+	}
+	if f.Limit > 0 {
+		// 続きがあるかを判定するため1件多く取得する
+		query += " LIMIT ?"
+		args = append(args, f.Limit+1)
+	}
+	orders, err := scanOrders(d.Query(query, args...))
+	if err != nil {
+		return nil, 0, err
+	}
+	var next int64
+	if f.Limit > 0 && len(orders) > f.Limit {
+		orders = orders[:f.Limit]
+		next = orders[len(orders)-1].ID
+	}
+	return orders, next, nil
 }
 
 func GetOrdersByUserIDAndLastTradeId(d QueryExecutor, userID int64, tradeID int64) ([]*Order, error) {
-	return scanOrders(d.Query(`SELECT * FROM orders WHERE user_id = ? AND trade_id IS NOT NULL AND trade_id > ? ORDER BY created_at ASC`, userID, tradeID))
+	return scanOrders(d.Query(`SELECT * FROM orders WHERE user_id = ? AND filled_amount > 0 AND EXISTS (SELECT 1 FROM order_fill WHERE order_fill.order_id = orders.id AND order_fill.trade_id > ?) ORDER BY created_at ASC`, userID, tradeID))
+}
+
+// GetOpenImmediateOrders は処理されずに残っているIOC/FOK注文を返します
+func GetOpenImmediateOrders(d QueryExecutor) ([]*Order, error) {
+	return scanOrders(d.Query("SELECT * FROM orders WHERE closed_at IS NULL AND time_in_force <> ? ORDER BY created_at ASC, id ASC", TimeInForceGTC))
 }
 
 func getOpenOrderByID(tx *sql.Tx, id int64) (*Order, error) {
@@ -67,53 +219,191 @@ func GetHighestBuyOrder(d QueryExecutor) (*Order, error) {
 }
 
 func FetchOrderRelation(d QueryExecutor, order *Order) error {
-	var err error
-	order.User, err = GetUserByID(d, order.UserID)
+	return FetchOrdersRelation(d, []*Order{order})
+}
+
+// FetchOrdersRelation は複数の注文のユーザーと約定、最後に成立した取引をまとめて取得します
+func FetchOrdersRelation(d QueryExecutor, orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	userIDs := make([]int64, 0, len(orders))
+	filledIDs := make([]int64, 0, len(orders))
+	for _, o := range orders {
+		userIDs = append(userIDs, o.UserID)
+		if o.FilledAmount > 0 {
+			filledIDs = append(filledIDs, o.ID)
+		}
+	}
+	users, err := getUsersByIDs(d, userIDs)
 	if err != nil {
-		return errors.Wrapf(err, "GetUserByID failed. id")
+		return errors.Wrap(err, "getUsersByIDs failed")
 	}
-	if order.TradeID > 0 {
-		order.Trade, err = GetTradeByID(d, order.TradeID)
-		if err != nil {
-			return errors.Wrapf(err, "GetTradeByID failed. id")
+	fills, err := getOrderFillsByOrderIDs(d, filledIDs)
+	if err != nil {
+		return errors.Wrap(err, "getOrderFillsByOrderIDs failed")
+	}
+	tradeIDs := make([]int64, 0, len(filledIDs))
+	for _, o := range orders {
+		o.User = users[o.UserID]
+		o.Fills = fills[o.ID]
+		if o.TradeID > 0 {
+			tradeIDs = append(tradeIDs, o.TradeID)
+		}
+	}
+	trades, err := getTradesByIDs(d, tradeIDs)
+	if err != nil {
+		return errors.Wrap(err, "getTradesByIDs failed")
+	}
+	for _, o := range orders {
+		if o.TradeID > 0 {
+			o.Trade = trades[o.TradeID]
 		}
 	}
 	return nil
 }
 
-func AddOrder(tx *sql.Tx, ot string, userID, amount, price int64) (*Order, error) {
-	if amount <= 0 || price <= 0 {
-		return nil, ErrParameterInvalid
+func getOrderFillsByOrderIDs(d QueryExecutor, orderIDs []int64) (map[int64][]*OrderFill, error) {
+	res := make(map[int64][]*OrderFill, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return res, nil
+	}
+	query, args := inQuery("SELECT * FROM order_fill WHERE order_id IN (%s) ORDER BY trade_id ASC", orderIDs)
+	fills, err := scanOrderFills(d.Query(query, args...))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fills {
+		res[f.OrderID] = append(res[f.OrderID], f)
+	}
+	return res, nil
+}
+
+// OrderRequest は1件の注文の内容です
+type OrderRequest struct {
+	Type   string `json:"type"`
+	Amount int64  `json:"amount"`
+	Price  int64  `json:"price"`
+	OrderOption
+}
+
+// normalize は注文の内容を検証し、省略された執行条件を補います
+func (r *OrderRequest) normalize() error {
+	if r.OrderType == "" {
+		r.OrderType = OrderTypeLimit
+	}
+	switch r.OrderType {
+	case OrderTypeLimit:
+		if r.TimeInForce == "" {
+			r.TimeInForce = TimeInForceGTC
+		}
+	case OrderTypeMarket:
+		// 成行注文は板に残さない
+		if r.TimeInForce == "" {
+			r.TimeInForce = TimeInForceIOC
+		}
+		if r.TimeInForce == TimeInForceGTC {
+			return ErrParameterInvalid
+		}
+		r.Price = 0
+	default:
+		return ErrParameterInvalid
+	}
+	switch r.TimeInForce {
+	case TimeInForceGTC, TimeInForceIOC, TimeInForceFOK:
+	default:
+		return ErrParameterInvalid
+	}
+	switch r.Type {
+	case OrderTypeBuy, OrderTypeSell:
+	default:
+		return ErrParameterInvalid
+	}
+	if r.Amount <= 0 || (r.Price <= 0 && r.OrderType == OrderTypeLimit) {
+		return ErrParameterInvalid
+	}
+	if r.ExpireAt != nil && (r.TimeInForce != TimeInForceGTC || !r.ExpireAt.After(time.Now())) {
+		return ErrParameterInvalid
+	}
+	return nil
+}
+
+// totalPrice は買い注文の残高確認に使う金額を返します
+func (r *OrderRequest) totalPrice() int64 {
+	if r.OrderType == OrderTypeMarket {
+		// 成行注文は板から見込まれる最も高い価格で確認する
+		return book.sweepPrice(r.Type, r.Amount) * r.Amount
+	}
+	return r.Price * r.Amount
+}
+
+func AddOrder(tx *sql.Tx, ot string, userID, amount, price int64, opt OrderOption) (*Order, error) {
+	req := OrderRequest{Type: ot, Amount: amount, Price: price, OrderOption: opt}
+	if err := req.normalize(); err != nil {
+		return nil, err
 	}
 	user, err := getUserByIDWithLock(tx, userID)
 	if err != nil {
 		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
 	}
+	switch req.Type {
+	case OrderTypeBuy:
+		if err = checkCredit(tx, user, req.totalPrice(), []OrderRequest{req}); err != nil {
+			return nil, err
+		}
+	case OrderTypeSell:
+		// 売り注文中の分を除いて保有している椅子しか売れない
+		available, err := getAvailableIsu(tx, user.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "getAvailableIsu failed")
+		}
+		if available < req.Amount {
+			logIsuInsufficient(tx, user, req)
+			return nil, ErrIsuInsufficient
+		}
+	}
+	return insertOrder(tx, user, req)
+}
+
+// checkCredit は買い注文の合計金額totalと手数料について銀行の残高を確認します
+func checkCredit(tx *sql.Tx, user *User, total int64, reqs []OrderRequest) error {
+	fees, err := GetFeeSchedule(tx)
+	if err != nil {
+		return errors.Wrap(err, "GetFeeSchedule failed")
+	}
 	bank, err := Isubank(tx)
 	if err != nil {
-		return nil, errors.Wrap(err, "newIsubank failed")
+		return errors.Wrap(err, "newIsubank failed")
 	}
-	switch ot {
-	case OrderTypeBuy:
-		totalPrice := price * amount
-		if err = bank.Check(user.BankID, totalPrice); err != nil {
-			sendLog(tx, "buy.error", map[string]interface{}{
+	if err = bank.Check(user.BankID, total+fees.maxFee(total)); err != nil {
+		for _, req := range reqs {
+			sendErrorLog(tx, "buy.error", map[string]interface{}{
 				"error":   err.Error(),
 				"user_id": user.ID,
-				"amount":  amount,
-				"price":   price,
+				"amount":  req.Amount,
+				"price":   req.Price,
 			})
-			if err == isubank.ErrCreditInsufficient {
-				return nil, ErrCreditInsufficient
-			}
-			return nil, errors.Wrap(err, "isubank check failed")
 		}
-	case OrderTypeSell:
-		// TODO 椅子の保有チェック
-	default:
-		return nil, ErrParameterInvalid
+		if isubank.IsCreditInsufficient(err) {
+			return ErrCreditInsufficient
+		}
+		return errors.Wrap(err, "isubank check failed")
 	}
-	res, err := tx.Exec(`INSERT INTO orders (type, user_id, amount, price, created_at) VALUES (?, ?, ?, ?, NOW(6))`, ot, user.ID, amount, price)
+	return nil
+}
+
+func logIsuInsufficient(tx *sql.Tx, user *User, req OrderRequest) {
+	sendErrorLog(tx, "sell.error", map[string]interface{}{
+		"error":   ErrIsuInsufficient.Error(),
+		"user_id": user.ID,
+		"amount":  req.Amount,
+		"price":   req.Price,
+	})
+}
+
+// insertOrder は確認済みの注文を登録し、GTC注文は板に載せます
+func insertOrder(tx *sql.Tx, user *User, req OrderRequest) (*Order, error) {
+	res, err := tx.Exec(`INSERT INTO orders (type, user_id, amount, price, order_type, time_in_force, expire_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, NOW(6))`, req.Type, user.ID, req.Amount, req.Price, req.OrderType, req.TimeInForce, req.ExpireAt)
 	if err != nil {
 		return nil, errors.Wrap(err, "insert order failed")
 	}
@@ -121,13 +411,22 @@ func AddOrder(tx *sql.Tx, ot string, userID, amount, price int64) (*Order, error
 	if err != nil {
 		return nil, errors.Wrap(err, "get order_id failed")
 	}
-	sendLog(tx, ot+".order", map[string]interface{}{
+	if err = sendLog(tx, req.Type+".order", map[string]interface{}{
 		"order_id": id,
 		"user_id":  user.ID,
-		"amount":   amount,
-		"price":    price,
-	})
-	return GetOrderByID(tx, id)
+		"amount":   req.Amount,
+		"price":    req.Price,
+	}); err != nil {
+		return nil, err
+	}
+	order, err := GetOrderByID(tx, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetOrderByID failed")
+	}
+	if !order.IsImmediate() {
+		book.add(tx, order)
+	}
+	return order, nil
 }
 
 func DeleteOrder(tx *sql.Tx, userID, orderID int64, reason string) error {
@@ -135,28 +434,149 @@ func DeleteOrder(tx *sql.Tx, userID, orderID int64, reason string) error {
 	if err != nil {
 		return errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
 	}
+	order, err := lockUserOpenOrder(tx, user, orderID)
+	if err != nil {
+		return err
+	}
+	return cancelOrder(tx, order, reason)
+}
+
+// CancelAllOrders はユーザーの未成立の注文を全て取り消し、取り消した注文のidを返します
+// otを指定した場合はその種別の注文のみを取り消します
+func CancelAllOrders(tx *sql.Tx, userID int64, ot, reason string) ([]int64, error) {
+	switch ot {
+	case "", OrderTypeBuy, OrderTypeSell:
+	default:
+		return nil, ErrParameterInvalid
+	}
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	query := "SELECT * FROM orders WHERE user_id = ? AND status = ?"
+	args := []interface{}{user.ID, OrderStatusOpen}
+	if ot != "" {
+		query += " AND type = ?"
+		args = append(args, ot)
+	}
+	orders, err := scanOrders(tx.Query(query+" ORDER BY id ASC FOR UPDATE", args...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "find open orders failed. user_id:%d", user.ID)
+	}
+	ids := make([]int64, 0, len(orders))
+	for _, order := range orders {
+		if err = cancelOrder(tx, order, reason); err != nil {
+			return nil, err
+		}
+		ids = append(ids, order.ID)
+	}
+	return ids, nil
+}
+
+// AmendOrder は未成立のGTC指値注文の脚数と価格を変更し、変更後の注文を返します
+// amountは成立済みの分を含めた注文全体の脚数です
+// 価格を変えずに脚数を減らすだけの場合は注文をそのまま更新するため時間優先は維持されます
+// それ以外の場合は注文を取り消し、残りの脚数で新しい注文を行います
+func AmendOrder(tx *sql.Tx, userID, orderID, amount, price int64) (*Order, error) {
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	order, err := lockUserOpenOrder(tx, user, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.OrderType != OrderTypeLimit || order.TimeInForce != TimeInForceGTC {
+		return nil, ErrParameterInvalid
+	}
+	if amount <= order.FilledAmount || price <= 0 {
+		return nil, ErrParameterInvalid
+	}
+	if price == order.Price && amount <= order.Amount {
+		if amount == order.Amount {
+			return order, nil
+		}
+		if _, err = tx.Exec(`UPDATE orders SET amount = ? WHERE id = ?`, amount, order.ID); err != nil {
+			return nil, errors.Wrap(err, "update orders for amend")
+		}
+		book.reduce(tx, order.ID, amount)
+		if err = sendLog(tx, order.Type+".amend", map[string]interface{}{
+			"order_id": order.ID,
+			"user_id":  user.ID,
+			"amount":   amount,
+			"price":    price,
+		}); err != nil {
+			return nil, err
+		}
+		order.Amount = amount
+		return order, nil
+	}
+
+	req := OrderRequest{
+		Type:   order.Type,
+		Amount: amount - order.FilledAmount,
+		Price:  price,
+		OrderOption: OrderOption{
+			OrderType:   order.OrderType,
+			TimeInForce: order.TimeInForce,
+			ExpireAt:    order.ExpireAt,
+		},
+	}
+	if err = req.normalize(); err != nil {
+		return nil, err
+	}
+	// 取り消す前に確認し、注文できない場合は元の注文を残す
+	switch req.Type {
+	case OrderTypeBuy:
+		if err = checkCredit(tx, user, req.totalPrice(), []OrderRequest{req}); err != nil {
+			return nil, err
+		}
+	case OrderTypeSell:
+		available, err := getAvailableIsu(tx, user.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "getAvailableIsu failed")
+		}
+		// 取り消す注文の分は売れる
+		if available+order.RemainingAmount() < req.Amount {
+			logIsuInsufficient(tx, user, req)
+			return nil, ErrIsuInsufficient
+		}
+	}
+	if err = cancelOrder(tx, order, CancelReasonAmended); err != nil {
+		return nil, err
+	}
+	return insertOrder(tx, user, req)
+}
+
+// lockUserOpenOrder はユーザーの未成立の注文をロックして取得します
+func lockUserOpenOrder(tx *sql.Tx, user *User, orderID int64) (*Order, error) {
 	order, err := getOrderByIDWithLock(tx, orderID)
 	switch {
 	case err == sql.ErrNoRows:
-		return ErrOrderNotFound
+		return nil, ErrOrderNotFound
 	case err != nil:
-		return errors.Wrapf(err, "getOrderByIDWithLock failed. id")
+		return nil, errors.Wrapf(err, "getOrderByIDWithLock failed. id")
 	case order.UserID != user.ID:
-		return ErrOrderNotFound
+		return nil, ErrOrderNotFound
 	case order.ClosedAt != nil:
-		return ErrOrderAlreadyClosed
+		return nil, ErrOrderAlreadyClosed
 	}
-	return cancelOrder(tx, order, reason)
+	return order, nil
+}
+
+// isExpired は有効期限を過ぎた注文かどうかを返します
+func (o *Order) isExpired(now time.Time) bool {
+	return o.ExpireAt != nil && !o.ExpireAt.After(now)
 }
 
-func cancelOrder(d QueryExecutor, order *Order, reason string) error {
-	if _, err := d.Exec(`UPDATE orders SET closed_at = NOW(6) WHERE id = ?`, order.ID); err != nil {
+func cancelOrder(tx *sql.Tx, order *Order, reason string) error {
+	if _, err := tx.Exec(`UPDATE orders SET status = ?, close_reason = ?, closed_at = NOW(6) WHERE id = ?`, OrderStatusCanceled, reason, order.ID); err != nil {
 		return errors.Wrap(err, "update orders for cancel")
 	}
-	sendLog(d, order.Type+".delete", map[string]interface{}{
+	book.remove(tx, order.ID)
+	return sendLog(tx, order.Type+".delete", map[string]interface{}{
 		"order_id": order.ID,
 		"user_id":  order.UserID,
 		"reason":   reason,
 	})
-	return nil
 }
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// OrderBatchMaxSize は一括で注文・取消できる件数の上限です
+const OrderBatchMaxSize = 100
+
+// ErrBatchFailed は一括処理のいずれかの項目が失敗したことを表します
+// 項目ごとのエラーは戻り値のスライスに入り、全ての項目が処理されません
+var ErrBatchFailed = errors.New("batch failed")
+
+// AddOrders は複数の注文をまとめて登録します
+// 1件でも登録できない注文がある場合はErrBatchFailedと項目ごとのエラーを返し、いずれの注文も登録しません
+// 買い注文の残高確認は合計金額について1回だけ行います
+func AddOrders(tx *sql.Tx, userID int64, reqs []OrderRequest) ([]*Order, []error, error) {
+	if len(reqs) == 0 || len(reqs) > OrderBatchMaxSize {
+		return nil, nil, ErrParameterInvalid
+	}
+	errs := make([]error, len(reqs))
+	failed := false
+	for i := range reqs {
+		if err := reqs[i].normalize(); err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+	if failed {
+		return nil, errs, ErrBatchFailed
+	}
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+
+	var total int64
+	buys := []OrderRequest{}
+	for _, req := range reqs {
+		if req.Type == OrderTypeBuy {
+			total += req.totalPrice()
+			buys = append(buys, req)
+		}
+	}
+	if len(buys) > 0 {
+		err = checkCredit(tx, user, total, buys)
+		switch {
+		case err == ErrCreditInsufficient:
+			for i, req := range reqs {
+				if req.Type == OrderTypeBuy {
+					errs[i] = err
+				}
+			}
+			failed = true
+		case err != nil:
+			return nil, nil, err
+		}
+	}
+
+	available, err := getAvailableIsu(tx, user.ID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getAvailableIsu failed")
+	}
+	for i, req := range reqs {
+		if req.Type != OrderTypeSell {
+			continue
+		}
+		// 同じ一括注文内の売り注文の分も差し引いて確認する
+		if available < req.Amount {
+			logIsuInsufficient(tx, user, req)
+			errs[i] = ErrIsuInsufficient
+			failed = true
+			continue
+		}
+		available -= req.Amount
+	}
+	if failed {
+		return nil, errs, ErrBatchFailed
+	}
+
+	orders := make([]*Order, 0, len(reqs))
+	for _, req := range reqs {
+		order, err := insertOrder(tx, user, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, errs, nil
+}
+
+// DeleteOrders は複数の注文をまとめて取り消します
+// 1件でも取り消せない注文がある場合はErrBatchFailedと項目ごとのエラーを返し、いずれの注文も取り消しません
+func DeleteOrders(tx *sql.Tx, userID int64, orderIDs []int64, reason string) ([]error, error) {
+	if len(orderIDs) == 0 || len(orderIDs) > OrderBatchMaxSize {
+		return nil, ErrParameterInvalid
+	}
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	errs := make([]error, len(orderIDs))
+	orders := make([]*Order, len(orderIDs))
+	seen := make(map[int64]bool, len(orderIDs))
+	failed := false
+	for i, id := range orderIDs {
+		if seen[id] {
+			errs[i] = ErrParameterInvalid
+			failed = true
+			continue
+		}
+		seen[id] = true
+		order, err := lockUserOpenOrder(tx, user, id)
+		switch {
+		case err == ErrOrderNotFound, err == ErrOrderAlreadyClosed:
+			errs[i] = err
+			failed = true
+		case err != nil:
+			return nil, err
+		}
+		orders[i] = order
+	}
+	if failed {
+		return errs, ErrBatchFailed
+	}
+	for _, order := range orders {
+		if err = cancelOrder(tx, order, reason); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,372 @@
+package model
+
+import (
+	"container/heap"
+	"container/list"
+	"database/sql"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// orderBook は未成立の注文をメモリ上に保持する板です
+// DBが正であり、板はトレード対象の選定にのみ利用します
+// トランザクション中の板の変更はコミットされるまで反映しません
+type orderBook struct {
+	mu      sync.RWMutex
+	sells   *priceLevels
+	buys    *priceLevels
+	index   map[int64]*list.Element
+	pending map[*sql.Tx][]func()
+	// version は板が変更されるたびに増加します
+	version uint64
+}
+
+// priceLevel は同一価格の注文を注文時間順(FIFO)で保持します
+type priceLevel struct {
+	price  int64
+	orders *list.List
+	pos    int
+}
+
+// priceLevels は価格ごとのpriceLevelを優先順位順に並べるheapです
+type priceLevels struct {
+	levels  []*priceLevel
+	byPrice map[int64]*priceLevel
+	less    func(a, b int64) bool
+}
+
+func newPriceLevels(less func(a, b int64) bool) *priceLevels {
+	return &priceLevels{
+		levels:  []*priceLevel{},
+		byPrice: make(map[int64]*priceLevel),
+		less:    less,
+	}
+}
+
+func (p *priceLevels) Len() int           { return len(p.levels) }
+func (p *priceLevels) Less(i, j int) bool { return p.less(p.levels[i].price, p.levels[j].price) }
+func (p *priceLevels) Swap(i, j int) {
+	p.levels[i], p.levels[j] = p.levels[j], p.levels[i]
+	p.levels[i].pos = i
+	p.levels[j].pos = j
+}
+
+func (p *priceLevels) Push(x interface{}) {
+	l := x.(*priceLevel)
+	l.pos = len(p.levels)
+	p.levels = append(p.levels, l)
+}
+
+func (p *priceLevels) Pop() interface{} {
+	n := len(p.levels)
+	l := p.levels[n-1]
+	p.levels = p.levels[:n-1]
+	return l
+}
+
+func (p *priceLevels) level(price int64) *priceLevel {
+	if l, ok := p.byPrice[price]; ok {
+		return l
+	}
+	l := &priceLevel{price: price, orders: list.New()}
+	p.byPrice[price] = l
+	heap.Push(p, l)
+	return l
+}
+
+func (p *priceLevels) removeLevel(l *priceLevel) {
+	heap.Remove(p, l.pos)
+	delete(p.byPrice, l.price)
+}
+
+// each は優先順位順にpriceLevelを走査します。fがfalseを返すと走査を終了します
+func (p *priceLevels) each(f func(*priceLevel) bool) {
+	h := &priceLevels{
+		levels: make([]*priceLevel, len(p.levels)),
+		less:   p.less,
+	}
+	for i, l := range p.levels {
+		h.levels[i] = &priceLevel{price: l.price, orders: l.orders, pos: i}
+	}
+	for h.Len() > 0 {
+		if !f(heap.Pop(h).(*priceLevel)) {
+			return
+		}
+	}
+}
+
+func newOrderBook() *orderBook {
+	b := &orderBook{pending: make(map[*sql.Tx][]func())}
+	b.reset(nil)
+	return b
+}
+
+var book = newOrderBook()
+
+// reset は板をordersだけにします。コミット前の変更はそのまま残ります
+func (b *orderBook) reset(orders []*Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sells = newPriceLevels(func(a, b int64) bool { return a < b })
+	b.buys = newPriceLevels(func(a, b int64) bool { return a > b })
+	b.index = make(map[int64]*list.Element, len(orders))
+	b.version++
+	for _, o := range orders {
+		b.addLocked(o)
+	}
+}
+
+func (b *orderBook) side(ot string) *priceLevels {
+	switch ot {
+	case OrderTypeBuy:
+		return b.buys
+	case OrderTypeSell:
+		return b.sells
+	}
+	return nil
+}
+
+// enqueue はトランザクションのコミット後に行う板の変更を登録します
+func (b *orderBook) enqueue(tx *sql.Tx, op func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[tx] = append(b.pending[tx], op)
+}
+
+// commit はトランザクション中の板の変更を反映します
+func (b *orderBook) commit(tx *sql.Tx) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ops := b.pending[tx]
+	delete(b.pending, tx)
+	for _, op := range ops {
+		op()
+	}
+}
+
+// discard はロールバックしたトランザクション中の板の変更を破棄します
+func (b *orderBook) discard(tx *sql.Tx) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, tx)
+}
+
+// add はコミット後に注文を板に載せます
+func (b *orderBook) add(tx *sql.Tx, o *Order) {
+	v := *o
+	b.enqueue(tx, func() { b.addLocked(&v) })
+}
+
+func (b *orderBook) addLocked(o *Order) {
+	if _, ok := b.index[o.ID]; ok {
+		return
+	}
+	side := b.side(o.Type)
+	if side == nil {
+		return
+	}
+	b.version++
+	v := &Order{
+		ID:           o.ID,
+		Type:         o.Type,
+		UserID:       o.UserID,
+		Amount:       o.Amount,
+		Price:        o.Price,
+		FilledAmount: o.FilledAmount,
+		CreatedAt:    o.CreatedAt,
+	}
+	orders := side.level(v.Price).orders
+	// 通常は末尾への追加になるが、コミット順と注文時間が前後した場合に備えて後ろから挿入位置を探す
+	e := orders.Back()
+	for e != nil && orderBefore(v, e.Value.(*Order)) {
+		e = e.Prev()
+	}
+	if e == nil {
+		b.index[v.ID] = orders.PushFront(v)
+	} else {
+		b.index[v.ID] = orders.InsertAfter(v, e)
+	}
+}
+
+func orderBefore(a, b *Order) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID < b.ID
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// remove はコミット後に注文を板から取り除きます
+func (b *orderBook) remove(tx *sql.Tx, id int64) {
+	b.enqueue(tx, func() { b.removeLocked(id) })
+}
+
+// fill はコミット後に注文の成立分を反映し、全て成立した注文は板から取り除きます
+func (b *orderBook) fill(tx *sql.Tx, id, amount int64) {
+	b.enqueue(tx, func() { b.fillLocked(id, amount) })
+}
+
+func (b *orderBook) fillLocked(id, amount int64) {
+	e, ok := b.index[id]
+	if !ok {
+		return
+	}
+	o := e.Value.(*Order)
+	o.FilledAmount += amount
+	b.version++
+	if o.RemainingAmount() <= 0 {
+		b.removeLocked(id)
+	}
+}
+
+// reduce はコミット後に注文の脚数を減らします。注文の順序は変わりません
+func (b *orderBook) reduce(tx *sql.Tx, id, amount int64) {
+	b.enqueue(tx, func() { b.reduceLocked(id, amount) })
+}
+
+func (b *orderBook) reduceLocked(id, amount int64) {
+	e, ok := b.index[id]
+	if !ok {
+		return
+	}
+	o := e.Value.(*Order)
+	o.Amount = amount
+	b.version++
+	if o.RemainingAmount() <= 0 {
+		b.removeLocked(id)
+	}
+}
+
+func (b *orderBook) removeLocked(id int64) {
+	e, ok := b.index[id]
+	if !ok {
+		return
+	}
+	delete(b.index, id)
+	b.version++
+	o := e.Value.(*Order)
+	side := b.side(o.Type)
+	l := side.byPrice[o.Price]
+	l.orders.Remove(e)
+	if l.orders.Len() == 0 {
+		side.removeLevel(l)
+	}
+}
+
+func (b *orderBook) get(id int64) *Order {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.index[id]
+	if !ok {
+		return nil
+	}
+	o := *e.Value.(*Order)
+	return &o
+}
+
+// best は最も優先順位の高い注文を返します
+func (b *orderBook) best(ot string) *Order {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	side := b.side(ot)
+	if side == nil || side.Len() == 0 {
+		return nil
+	}
+	o := *side.levels[0].orders.Front().Value.(*Order)
+	return &o
+}
+
+// counterSide は注文種別に対して相手方となる板と、指値に対して成立しうる価格かを判定する関数を返します
+func (b *orderBook) counterSide(ot string, price int64) (*priceLevels, func(int64) bool) {
+	switch ot {
+	case OrderTypeBuy:
+		return b.sells, func(p int64) bool { return p <= price }
+	case OrderTypeSell:
+		return b.buys, func(p int64) bool { return p >= price }
+	}
+	return nil, nil
+}
+
+// matchable は注文orderよりも先に注文された相手注文のうち、指値priceに対して成立しうるもののIDを優先順位順に返します
+// 後から注文された相手注文にとってはorderが板の注文となるため、ここでは取引しません
+func (b *orderBook) matchable(order *Order, price int64) []int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	side, crosses := b.counterSide(order.Type, price)
+	if side == nil {
+		return nil
+	}
+	ids := []int64{}
+	side.each(func(l *priceLevel) bool {
+		if !crosses(l.price) {
+			return false
+		}
+		for e := l.orders.Front(); e != nil; e = e.Next() {
+			if o := e.Value.(*Order); orderBefore(o, order) {
+				ids = append(ids, o.ID)
+			}
+		}
+		return true
+	})
+	return ids
+}
+
+// sweepPrice は成行注文で指定脚数を成立させるために必要な最も不利な価格を返します
+// 板の脚数が不足している場合は板の最も不利な価格、相手注文が無い場合は0を返します
+func (b *orderBook) sweepPrice(ot string, amount int64) int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	side, _ := b.counterSide(ot, 0)
+	if side == nil {
+		return 0
+	}
+	var price, total int64
+	side.each(func(l *priceLevel) bool {
+		price = l.price
+		for e := l.orders.Front(); e != nil; e = e.Next() {
+			total += e.Value.(*Order).RemainingAmount()
+		}
+		return total < amount
+	})
+	return price
+}
+
+func (b *orderBook) currentVersion() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.version
+}
+
+// depth は売り・買いそれぞれについて価格ごとに集計した注文を優先順位順に最大n件と、集計時点のversionを返します
+func (b *orderBook) depth(n int) (asks, bids []*PriceLevel, version uint64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.sells.aggregate(n), b.buys.aggregate(n), b.version
+}
+
+func (p *priceLevels) aggregate(n int) []*PriceLevel {
+	levels := []*PriceLevel{}
+	p.each(func(l *priceLevel) bool {
+		if len(levels) >= n {
+			return false
+		}
+		pl := &PriceLevel{Price: l.price}
+		for e := l.orders.Front(); e != nil; e = e.Next() {
+			pl.Amount += e.Value.(*Order).RemainingAmount()
+			pl.Orders++
+		}
+		levels = append(levels, pl)
+		return true
+	})
+	return levels
+}
+
+// InitOrderBook は未成立の注文から板を再構築します
+func InitOrderBook(d QueryExecutor) error {
+	orders, err := scanOrders(d.Query("SELECT * FROM orders WHERE closed_at IS NULL AND time_in_force = ? ORDER BY created_at ASC, id ASC", TimeInForceGTC))
+	if err != nil {
+		return errors.Wrap(err, "find open orders")
+	}
+	book.reset(orders)
+	return nil
+}
@@ -0,0 +1,155 @@
+package model
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testBaseTime = time.Date(2018, 10, 16, 10, 0, 0, 0, time.UTC)
+
+func testOrder(id int64, ot string, price, amount int64, sec int) *Order {
+	return &Order{
+		ID:          id,
+		Type:        ot,
+		Amount:      amount,
+		Price:       price,
+		OrderType:   OrderTypeLimit,
+		TimeInForce: TimeInForceGTC,
+		CreatedAt:   testBaseTime.Add(time.Duration(sec) * time.Second),
+	}
+}
+
+// testBook はordersを1つのトランザクションでコミットした板を返します
+func testBook(orders ...*Order) *orderBook {
+	b := newOrderBook()
+	tx := new(sql.Tx)
+	for _, o := range orders {
+		b.add(tx, o)
+	}
+	b.commit(tx)
+	return b
+}
+
+func TestOrderBookPriceTimePriority(t *testing.T) {
+	b := testBook(
+		testOrder(1, OrderTypeSell, 1010, 1, 0),
+		testOrder(2, OrderTypeSell, 1000, 1, 1),
+		testOrder(3, OrderTypeSell, 1000, 1, 2),
+		testOrder(4, OrderTypeBuy, 990, 1, 3),
+		testOrder(5, OrderTypeBuy, 995, 1, 4),
+		testOrder(6, OrderTypeBuy, 995, 1, 5),
+	)
+	if o := b.best(OrderTypeSell); o == nil || o.ID != 2 {
+		t.Errorf("best sell: got %v, want 2", o)
+	}
+	if o := b.best(OrderTypeBuy); o == nil || o.ID != 5 {
+		t.Errorf("best buy: got %v, want 5", o)
+	}
+
+	// 価格が有利な順、同じ価格は先に注文された順
+	buy := testOrder(7, OrderTypeBuy, 1010, 3, 6)
+	if got, want := b.matchable(buy, buy.Price), []int64{2, 3, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable sells: got %v, want %v", got, want)
+	}
+	sell := testOrder(8, OrderTypeSell, 990, 3, 7)
+	if got, want := b.matchable(sell, sell.Price), []int64{5, 6, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable buys: got %v, want %v", got, want)
+	}
+	// 指値より不利な価格の注文は含まない
+	if got, want := b.matchable(buy, 1000), []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable sells at 1000: got %v, want %v", got, want)
+	}
+}
+
+func TestOrderBookMatchableOnlyEarlierOrders(t *testing.T) {
+	b := testBook(
+		testOrder(1, OrderTypeSell, 1000, 1, 0),
+		testOrder(2, OrderTypeBuy, 1000, 1, 1),
+		testOrder(3, OrderTypeSell, 990, 1, 2),
+	)
+	// 買い注文2にとって後から注文された売り注文3は板の注文ではない
+	buy := b.get(2)
+	if got, want := b.matchable(buy, buy.Price), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable for 2: got %v, want %v", got, want)
+	}
+	sell := b.get(3)
+	if got, want := b.matchable(sell, sell.Price), []int64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable for 3: got %v, want %v", got, want)
+	}
+}
+
+func TestOrderBookKeepsTimePriorityOnLateCommit(t *testing.T) {
+	// 先に注文された注文のトランザクションが後からコミットされても注文時間順に並べる
+	b := testBook(testOrder(2, OrderTypeSell, 1000, 1, 2))
+	tx := new(sql.Tx)
+	b.add(tx, testOrder(1, OrderTypeSell, 1000, 1, 1))
+	b.commit(tx)
+	buy := testOrder(3, OrderTypeBuy, 1000, 2, 3)
+	if got, want := b.matchable(buy, buy.Price), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable: got %v, want %v", got, want)
+	}
+}
+
+func TestOrderBookFillAndReduce(t *testing.T) {
+	b := testBook(
+		testOrder(1, OrderTypeSell, 1000, 5, 0),
+		testOrder(2, OrderTypeSell, 1000, 3, 1),
+	)
+	tx := new(sql.Tx)
+	b.fill(tx, 1, 2)
+	b.reduce(tx, 2, 1)
+	b.commit(tx)
+	if o := b.get(1); o == nil || o.FilledAmount != 2 || o.RemainingAmount() != 3 {
+		t.Errorf("order 1 after fill: got %+v", o)
+	}
+	if o := b.get(2); o == nil || o.Amount != 1 {
+		t.Errorf("order 2 after reduce: got %+v", o)
+	}
+	// 脚数を減らしても時間優先は変わらない
+	buy := testOrder(3, OrderTypeBuy, 1000, 4, 2)
+	if got, want := b.matchable(buy, buy.Price), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matchable: got %v, want %v", got, want)
+	}
+
+	tx = new(sql.Tx)
+	b.fill(tx, 1, 3)
+	b.commit(tx)
+	if o := b.get(1); o != nil {
+		t.Errorf("filled order should be removed: got %+v", o)
+	}
+	if o := b.best(OrderTypeSell); o == nil || o.ID != 2 {
+		t.Errorf("best sell: got %v, want 2", o)
+	}
+}
+
+func TestOrderBookAppliesChangesOnCommit(t *testing.T) {
+	b := testBook(testOrder(1, OrderTypeSell, 1000, 1, 0))
+	committed, rolledBack := new(sql.Tx), new(sql.Tx)
+	b.add(committed, testOrder(2, OrderTypeSell, 990, 1, 1))
+	b.remove(rolledBack, 1)
+	b.add(rolledBack, testOrder(3, OrderTypeSell, 980, 1, 2))
+
+	if o := b.best(OrderTypeSell); o == nil || o.ID != 1 {
+		t.Fatalf("changes must not be visible before commit: got %v", o)
+	}
+	version := b.currentVersion()
+
+	// 板を作り直してもコミット前の変更は残る
+	b.reset([]*Order{testOrder(1, OrderTypeSell, 1000, 1, 0)})
+	b.commit(committed)
+	b.discard(rolledBack)
+	if o := b.best(OrderTypeSell); o == nil || o.ID != 2 {
+		t.Errorf("best sell after commit: got %v, want 2", o)
+	}
+	if b.get(1) == nil {
+		t.Error("order 1 removed by rolled back transaction")
+	}
+	if b.get(3) != nil {
+		t.Error("order 3 added by rolled back transaction")
+	}
+	if b.currentVersion() == version {
+		t.Error("version is not changed by commit")
+	}
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"isucon8/isulogger"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LogRelayBatchSize はlog_outboxから一度に読み出すログの件数です
+	LogRelayBatchSize = 1000
+
+	// logRelayLockName は複数のプロセスが同じログを同時に送信しないためのロックの名前です
+	logRelayLockName = "isucoin.log_relay"
+)
+
+// LogOutboxRetention は送信済みのログをlog_outboxに残しておく期間です
+var LogOutboxRetention = time.Hour
+
+// sendLog はログをlog_outboxに追加します
+// dがトランザクションの場合、ログはコミットされた場合にだけRelayLogsによって送信されます
+func sendLog(d QueryExecutor, tag string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "log marshal failed. tag:%s", tag)
+	}
+	if _, err = d.Exec(`INSERT INTO log_outbox (tag, data, created_at) VALUES (?, ?, NOW(6))`, tag, data); err != nil {
+		return errors.Wrapf(err, "insert log_outbox failed. tag:%s", tag)
+	}
+	return nil
+}
+
+type outboxLog struct {
+	id   int64
+	body json.RawMessage
+}
+
+// RunLogRelay はctxがキャンセルされるまでinterval毎にlog_outboxの未送信のログを送信します
+func RunLogRelay(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := RelayLogs(ctx, db); err != nil {
+				log.Printf("[WARN] relay logs failed. err:%s", err)
+			}
+		}
+	}
+}
+
+// RelayLogs はlog_outboxの未送信のログを追加された順に /send_bulk で送信し、送信できたログにsent_atを記録します
+// 送信後sent_atの記録前に失敗した場合は次回に再送するため、同じログが複数回送信されることがあります
+// 他のプロセスが送信中の場合や、/initialize の前でISULOGGERの設定が無い場合は何もしません
+func RelayLogs(ctx context.Context, db *sql.DB) error {
+	logger, err := Logger(db)
+	switch {
+	case errors.Cause(err) == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "new logger failed")
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get connection failed")
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, logRelayLockName).Scan(&locked); err != nil {
+		return errors.Wrap(err, "get lock failed")
+	}
+	if locked.Int64 != 1 {
+		return nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `DO RELEASE_LOCK(?)`, logRelayLockName); err != nil {
+			log.Printf("[WARN] release lock failed. err:%s", err)
+		}
+	}()
+
+	for {
+		logs, err := getUnsentLogs(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(logs); {
+			n := nextLogBatch(logs[i:])
+			if err = shipLogs(ctx, conn, logger, logs[i:i+n]); err != nil {
+				return err
+			}
+			i += n
+		}
+		if len(logs) < LogRelayBatchSize {
+			break
+		}
+	}
+	if _, err = conn.ExecContext(ctx, `DELETE FROM log_outbox WHERE sent_at < NOW(6) - INTERVAL ? SECOND`, int64(LogOutboxRetention/time.Second)); err != nil {
+		return errors.Wrap(err, "delete sent logs failed")
+	}
+	return nil
+}
+
+func getUnsentLogs(ctx context.Context, conn *sql.Conn) ([]outboxLog, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT id, tag, data, created_at FROM log_outbox WHERE sent_at IS NULL ORDER BY id ASC LIMIT ?`, LogRelayBatchSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "select log_outbox failed")
+	}
+	defer rows.Close()
+	logs := []outboxLog{}
+	for rows.Next() {
+		var (
+			l    outboxLog
+			data []byte
+			t    isulogger.Log
+		)
+		if err = rows.Scan(&l.id, &t.Tag, &data, &t.Time); err != nil {
+			return nil, errors.Wrap(err, "scan log_outbox failed")
+		}
+		t.Data = json.RawMessage(data)
+		if l.body, err = json.Marshal(t); err != nil {
+			return nil, errors.Wrapf(err, "log marshal failed. id:%d", l.id)
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// nextLogBatch は先頭から1回のリクエストで送信できるログの件数を返します。1件は必ず含めます
+func nextLogBatch(logs []outboxLog) int {
+	// "[" + 各ログを","で区切ったもの + "]\n" のbodyのサイズ
+	size := 3 + len(logs[0].body)
+	n := 1
+	for ; n < len(logs); n++ {
+		if size += len(logs[n].body) + 1; size > isulogger.MaxBodySize {
+			break
+		}
+	}
+	return n
+}
+
+// shipLogs はログを送信し、sent_atを記録します
+// 再送しても成功しないログは破棄したものとしてsent_atを記録します
+func shipLogs(ctx context.Context, conn *sql.Conn, logger *isulogger.Isulogger, logs []outboxLog) error {
+	bulk := make([]json.RawMessage, len(logs))
+	ids := make([]int64, len(logs))
+	for i, l := range logs {
+		bulk[i] = l.body
+		ids[i] = l.id
+	}
+	if len(logs) == 1 && len(logs[0].body)+3 > isulogger.MaxBodySize {
+		log.Printf("[WARN] log is too large. log is dropped. id:%d", logs[0].id)
+	} else if err := logger.SendBulkRaw(bulk); err != nil {
+		if se, ok := err.(*isulogger.StatusError); !ok || se.Temporary() {
+			return errors.Wrap(err, "logger send_bulk failed")
+		}
+		log.Printf("[WARN] logger send_bulk failed. %d logs are dropped. err:%s", len(logs), err)
+	}
+	query, args := inQuery(`UPDATE log_outbox SET sent_at = NOW(6) WHERE id IN (%s)`, ids)
+	if _, err := conn.ExecContext(ctx, query, args...); err != nil {
+		return errors.Wrap(err, "update log_outbox failed")
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Portfolio はユーザーの取引から求めた椅子の保有状況と損益です
+// 取得金額は移動平均法で求めます。手数料は取得金額に含めず、支払った時点の確定損益とします
+type Portfolio struct {
+	// 取引で増減した椅子の脚数
+	Position int64 `json:"position"`
+	// 保有している椅子の取得金額
+	Cost int64 `json:"cost"`
+	// 保有している椅子1脚あたりの平均取得単価
+	AverageCost float64 `json:"average_cost"`
+	// 売却によって確定した損益
+	RealizedPnL int64 `json:"realized_pnl"`
+	// 支払った手数料の合計
+	Fee int64 `json:"fee"`
+	// 保有している椅子をLastPriceで評価した損益
+	UnrealizedPnL int64 `json:"unrealized_pnl"`
+	// 評価に使った取引価格
+	LastPrice int64 `json:"last_price"`
+}
+
+// PortfolioPoint はある足の終了時点のPortfolioです
+type PortfolioPoint struct {
+	Time time.Time `json:"time"`
+	*Portfolio
+}
+
+type portfolioFill struct {
+	orderType string
+	amount    int64
+	price     int64
+	fee       int64
+	tradedAt  time.Time
+}
+
+// position は取引を順に反映して保有状況と確定損益を求めます
+type position struct {
+	amount   int64
+	cost     int64
+	realized int64
+	fee      int64
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (p *position) apply(f portfolioFill) {
+	q := f.amount
+	if f.orderType == OrderTypeSell {
+		q = -q
+	}
+	if p.amount != 0 && (p.amount > 0) != (q > 0) {
+		// 反対売買の分は平均取得単価で損益を確定させる
+		n := abs(q)
+		if abs(p.amount) < n {
+			n = abs(p.amount)
+		}
+		closed := p.cost * n / abs(p.amount)
+		c := n
+		if p.amount > 0 {
+			c = -n
+		}
+		p.realized += -c*f.price - closed
+		p.cost -= closed
+		p.amount += c
+		q -= c
+	}
+	p.amount += q
+	p.cost += q * f.price
+	p.realized -= f.fee
+	p.fee += f.fee
+}
+
+func (p *position) portfolio(price int64) *Portfolio {
+	pf := &Portfolio{
+		Position:    p.amount,
+		Cost:        p.cost,
+		RealizedPnL: p.realized,
+		Fee:         p.fee,
+		LastPrice:   price,
+	}
+	if p.amount != 0 {
+		pf.AverageCost = float64(p.cost) / float64(p.amount)
+		if price > 0 {
+			pf.UnrealizedPnL = p.amount*price - p.cost
+		}
+	}
+	return pf
+}
+
+// getPortfolioFills はユーザーの注文のto以前の約定を取引順に返します。toがゼロ値の場合は全ての約定を返します
+func getPortfolioFills(d QueryExecutor, userID int64, to time.Time) ([]portfolioFill, error) {
+	query := `
+		SELECT o.type, f.amount, t.price, f.fee, t.created_at
+		FROM orders o
+		JOIN order_fill f ON f.order_id = o.id
+		JOIN trade t ON t.id = f.trade_id
+		WHERE o.user_id = ? AND o.filled_amount > 0`
+	args := []interface{}{userID}
+	if !to.IsZero() {
+		query += " AND t.created_at < ?"
+		args = append(args, to)
+	}
+	rows, err := d.Query(query+" ORDER BY f.trade_id ASC, f.id ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fills := []portfolioFill{}
+	for rows.Next() {
+		var f portfolioFill
+		if err = rows.Scan(&f.orderType, &f.amount, &f.price, &f.fee, &f.tradedAt); err != nil {
+			return nil, err
+		}
+		fills = append(fills, f)
+	}
+	return fills, rows.Err()
+}
+
+// GetPortfolio はユーザーの現在の保有状況と、直近の取引価格で評価した損益を返します
+func GetPortfolio(d QueryExecutor, userID int64) (*Portfolio, error) {
+	var price int64
+	trade, err := GetLatestTrade(d)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	default:
+		price = trade.Price
+	}
+	fills, err := getPortfolioFills(d, userID, time.Time{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "getPortfolioFills failed. user_id:%d", userID)
+	}
+	var p position
+	for _, f := range fills {
+		p.apply(f)
+	}
+	return p.portfolio(price), nil
+}
+
+// GetPortfolioHistory はfrom以降to以前に開始した足ごとに、足の終了時点の保有状況と足の終値で評価した損益を返します
+// 取引の無かった足は含みません。from, toの扱いはGetCandlestickDataRangeと同じです
+func GetPortfolioHistory(d QueryExecutor, userID int64, resolution string, from, to time.Time) ([]*PortfolioPoint, error) {
+	r, ok := getCandlestickResolution(resolution)
+	if !ok {
+		return nil, ErrParameterInvalid
+	}
+	candles, err := GetCandlestickDataRange(d, resolution, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*PortfolioPoint, 0, len(candles))
+	if len(candles) == 0 {
+		return points, nil
+	}
+	fills, err := getPortfolioFills(d, userID, candles[len(candles)-1].Time.Add(r.duration))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getPortfolioFills failed. user_id:%d", userID)
+	}
+	var p position
+	i := 0
+	for _, c := range candles {
+		end := c.Time.Add(r.duration)
+		for ; i < len(fills) && fills[i].tradedAt.Before(end); i++ {
+			p.apply(fills[i])
+		}
+		points = append(points, &PortfolioPoint{
+			Time:      c.Time,
+			Portfolio: p.portfolio(c.Close),
+		})
+	}
+	return points, nil
+}
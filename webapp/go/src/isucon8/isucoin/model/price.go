@@ -0,0 +1,59 @@
+package model
+
+import (
+	"github.com/pkg/errors"
+)
+
+// 取引の単価の決め方
+const (
+	PricePolicyAggressor = "aggressor"
+	PricePolicyResting   = "resting"
+	PricePolicyMidpoint  = "midpoint"
+)
+
+// PricePolicy は取引の単価を決めます
+// aggressorは板の注文と取引する注文の単価(成行注文は板から見込まれる最も不利な価格)、
+// restingは取引する板の注文のうち最も不利な単価です
+// 返す単価はaggressorとrestingの間でなければなりません
+type PricePolicy func(aggressor, resting int64) int64
+
+var pricePolicies = map[string]PricePolicy{
+	PricePolicyAggressor: func(aggressor, resting int64) int64 { return aggressor },
+	PricePolicyResting:   func(aggressor, resting int64) int64 { return resting },
+	PricePolicyMidpoint:  func(aggressor, resting int64) int64 { return (aggressor + resting) / 2 },
+}
+
+// ExecutionPricePolicy は取引の単価の決め方です
+// 板の注文の単価で取引することで、板の注文と取引する注文は指値よりも有利な価格で取引できます
+var ExecutionPricePolicy = pricePolicies[PricePolicyResting]
+
+// GetPricePolicy は名前に対応するPricePolicyを返します
+func GetPricePolicy(name string) (PricePolicy, bool) {
+	p, ok := pricePolicies[name]
+	return p, ok
+}
+
+// restingPrice は取引する板の注文のうち最も不利な単価を返します
+func restingPrice(ot string, makers []tradeFill) int64 {
+	var price int64
+	for i, m := range makers {
+		if i == 0 || (ot == OrderTypeBuy && m.order.Price > price) || (ot == OrderTypeSell && m.order.Price < price) {
+			price = m.order.Price
+		}
+	}
+	return price
+}
+
+// validateTradePrice は単価priceが取引する全ての注文にとって矛盾のない価格かを確認します
+func validateTradePrice(ot string, limit int64, makers []tradeFill, price int64) error {
+	for _, m := range makers {
+		sell, buy := m.order.Price, limit
+		if ot == OrderTypeSell {
+			sell, buy = limit, m.order.Price
+		}
+		if price < sell || buy < price {
+			return errors.Errorf("trade price out of range. price:%d, sell:%d, buy:%d", price, sell, buy)
+		}
+	}
+	return nil
+}
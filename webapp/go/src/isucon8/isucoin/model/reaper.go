@@ -0,0 +1,65 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CancelExpiredOrders は有効期限を過ぎた注文を取り消します
+func CancelExpiredOrders(db *sql.DB) error {
+	orders, err := scanOrders(db.Query("SELECT * FROM orders WHERE closed_at IS NULL AND expire_at <= NOW(6) ORDER BY expire_at ASC"))
+	if err != nil {
+		return errors.Wrap(err, "find expired orders")
+	}
+	for _, o := range orders {
+		if err = cancelExpiredOrder(db, o.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cancelExpiredOrder(db *sql.DB, orderID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction failed")
+	}
+	order, err := getOrderByIDWithLock(tx, orderID)
+	if err != nil {
+		RollbackTx(tx)
+		return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", orderID)
+	}
+	if order.ClosedAt != nil || !order.isExpired(time.Now()) {
+		// ロックを取る間に成立または取り消しされた
+		return RollbackTx(tx)
+	}
+	if err = cancelOrder(tx, order, CancelReasonExpired); err != nil {
+		RollbackTx(tx)
+		return err
+	}
+	if err = CommitTx(tx); err != nil {
+		return errors.Wrap(err, "commit failed")
+	}
+	PublishBestPrice()
+	return nil
+}
+
+// RunOrderReaper はctxがキャンセルされるまでinterval毎に有効期限切れの注文を取り消します
+func RunOrderReaper(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := CancelExpiredOrders(db); err != nil {
+				log.Printf("[WARN] cancel expired orders failed. err:%s", err)
+			}
+		}
+	}
+}
@@ -16,7 +16,7 @@ func scanCandlestickDatas(rows *sql.Rows, e error) (candlestickDatas []*Candlest
 	candlestickDatas = []*CandlestickData{}
 	for rows.Next() {
 		var v CandlestickData
-		if err = rows.Scan(&v.Time, &v.Open, &v.Close, &v.High, &v.Low); err != nil {
+		if err = rows.Scan(&v.Time, &v.Open, &v.Close, &v.High, &v.Low, &v.Volume, &v.TradeCount, &v.VWAP); err != nil {
 			return
 		}
 		candlestickDatas = append(candlestickDatas, &v)
@@ -46,11 +46,15 @@ func scanOrders(rows *sql.Rows, e error) (orders []*Order, err error) {
 	orders = []*Order{}
 	for rows.Next() {
 		var v Order
+		var expireAt mysql.NullTime
 		var closedAt mysql.NullTime
 		var tradeID sql.NullInt64
-		if err = rows.Scan(&v.ID, &v.Type, &v.UserID, &v.Amount, &v.Price, &closedAt, &tradeID, &v.CreatedAt); err != nil {
+		if err = rows.Scan(&v.ID, &v.Type, &v.UserID, &v.Amount, &v.Price, &v.OrderType, &v.TimeInForce, &expireAt, &v.FilledAmount, &v.Fee, &v.Status, &v.CloseReason, &closedAt, &tradeID, &v.CreatedAt); err != nil {
 			return nil, err
 		}
+		if expireAt.Valid {
+			v.ExpireAt = &expireAt.Time
+		}
 		if closedAt.Valid {
 			v.ClosedAt = &closedAt.Time
 		}
@@ -74,6 +78,66 @@ func scanOrder(rows *sql.Rows, err error) (*Order, error) {
 	return nil, sql.ErrNoRows
 }
 
+func scanOrderFills(rows *sql.Rows, e error) (orderFills []*OrderFill, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	orderFills = []*OrderFill{}
+	for rows.Next() {
+		var v OrderFill
+		if err = rows.Scan(&v.ID, &v.OrderID, &v.TradeID, &v.Amount, &v.Fee, &v.CreatedAt); err != nil {
+			return
+		}
+		orderFills = append(orderFills, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanOrderFill(rows *sql.Rows, err error) (*OrderFill, error) {
+	v, err := scanOrderFills(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func scanSessions(rows *sql.Rows, e error) (sessions []*Session, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	sessions = []*Session{}
+	for rows.Next() {
+		var v Session
+		if err = rows.Scan(&v.ID, &v.UserID, &v.Data, &v.ExpiresAt, &v.CreatedAt); err != nil {
+			return
+		}
+		sessions = append(sessions, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanSession(rows *sql.Rows, err error) (*Session, error) {
+	v, err := scanSessions(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
 func scanSettings(rows *sql.Rows, e error) (settings []*Setting, err error) {
 	if e != nil {
 		return nil, e
@@ -104,6 +168,40 @@ func scanSetting(rows *sql.Rows, err error) (*Setting, error) {
 	return nil, sql.ErrNoRows
 }
 
+func scanStopOrders(rows *sql.Rows, e error) (stopOrders []*StopOrder, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	stopOrders = []*StopOrder{}
+	for rows.Next() {
+		var v StopOrder
+		var closedAt mysql.NullTime
+		if err = rows.Scan(&v.ID, &v.Type, &v.UserID, &v.Amount, &v.Price, &v.StopPrice, &v.OrderType, &v.Status, &v.CloseReason, &v.OrderID, &closedAt, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		if closedAt.Valid {
+			v.ClosedAt = &closedAt.Time
+		}
+		stopOrders = append(stopOrders, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanStopOrder(rows *sql.Rows, err error) (*StopOrder, error) {
+	v, err := scanStopOrders(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
 func scanTrades(rows *sql.Rows, e error) (trades []*Trade, err error) {
 	if e != nil {
 		return nil, e
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//go:generate scanner
+type Session struct {
+	ID        string
+	UserID    int64
+	Data      []byte
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// GetSession は有効期限内のセッションを返します
+func GetSession(d QueryExecutor, id string) (*Session, error) {
+	return scanSession(d.Query("SELECT * FROM session WHERE id = ? AND expires_at > NOW(6)", id))
+}
+
+// SaveSession はセッションを保存します。user_idはセッションをまとめて無効にするために利用します
+func SaveSession(d QueryExecutor, id string, userID int64, data []byte, expiresAt time.Time) error {
+	_, err := d.Exec(`INSERT INTO session (id, user_id, data, expires_at, created_at) VALUES (?, ?, ?, ?, NOW(6)) ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), data = VALUES(data), expires_at = VALUES(expires_at)`, id, userID, data, expiresAt)
+	return errors.Wrapf(err, "save session failed. id:%s", id)
+}
+
+func DeleteSession(d QueryExecutor, id string) error {
+	_, err := d.Exec(`DELETE FROM session WHERE id = ?`, id)
+	return errors.Wrapf(err, "delete session failed. id:%s", id)
+}
+
+// DeleteSessionsByUserID はユーザーの全てのセッションを削除します
+func DeleteSessionsByUserID(d QueryExecutor, userID int64) error {
+	_, err := d.Exec(`DELETE FROM session WHERE user_id = ?`, userID)
+	return errors.Wrapf(err, "delete sessions failed. user_id:%d", userID)
+}
+
+// DeleteAllSessions は全てのセッションを削除します
+func DeleteAllSessions(d QueryExecutor) error {
+	_, err := d.Exec(`DELETE FROM session`)
+	return errors.Wrap(err, "delete all sessions failed")
+}
@@ -1,9 +1,15 @@
 package model
 
 import (
+	"context"
+	"database/sql"
 	"isucon8/isubank"
 	"isucon8/isulogger"
 	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -21,20 +27,126 @@ type Setting struct {
 	Val  string
 }
 
+// SettingCacheTTL は設定のキャッシュを読み直すまでの時間です
+// 他のプロセスでの設定の変更はこの時間が経過するまで反映されません
+var SettingCacheTTL = time.Second
+
+// settingCache はsettingテーブルの内容をメモリ上に保持します
+// SetSettingやInvalidateSettingsで破棄され、次の参照時に読み直します
+type settingCache struct {
+	mu       sync.RWMutex
+	vals     map[string]string
+	loadedAt time.Time
+	// version は破棄するたびに増加します。読み込み中に破棄された場合は読み込んだ内容を保持しません
+	version uint64
+}
+
+var settings = &settingCache{}
+
+func (c *settingCache) get(k string) (val string, found, loaded bool, version uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.vals == nil || time.Since(c.loadedAt) >= SettingCacheTTL {
+		return "", false, false, c.version
+	}
+	val, found = c.vals[k]
+	return val, found, true, c.version
+}
+
+func (c *settingCache) store(vals map[string]string, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version == version {
+		c.vals = vals
+		c.loadedAt = time.Now()
+	}
+}
+
+func (c *settingCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vals = nil
+	c.version++
+}
+
+// InvalidateSettings は設定のキャッシュを破棄します
+// トランザクション内でSetSettingした場合はコミット後にも呼び出してください
+func InvalidateSettings() {
+	settings.invalidate()
+}
+
 func SetSetting(d QueryExecutor, k, v string) error {
 	_, err := d.Exec(`INSERT INTO setting (name, val) VALUES (?, ?) ON DUPLICATE KEY UPDATE val = VALUES(val)`, k, v)
+	settings.invalidate()
 	return err
 }
 
 func GetSetting(d QueryExecutor, k string) (string, error) {
-	s, err := scanSetting(d.Query(`SELECT * FROM setting WHERE name = ?`, k))
-	if err != nil {
-		return "", err
+	val, found, loaded, version := settings.get(k)
+	if !loaded {
+		all, err := scanSettings(d.Query(`SELECT * FROM setting`))
+		if err != nil {
+			return "", err
+		}
+		vals := make(map[string]string, len(all))
+		for _, s := range all {
+			vals[s.Name] = s.Val
+		}
+		settings.store(vals, version)
+		val, found = vals[k]
 	}
-	return s.Val, nil
+	if !found {
+		return "", sql.ErrNoRows
+	}
+	return val, nil
+}
+
+// httpClient はいすこん銀行とISULOGGERへのリクエストで共有するクライアントです
+// 同じホストへ多数のリクエストを並行して送るため、接続を使い回せるようにidle接続を多めに保持します
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        512,
+		MaxIdleConnsPerHost: 256,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// clientCache は設定から作成したクライアントを、設定が変わるまで使い回します
+type clientCache struct {
+	mu        sync.Mutex
+	bank      *isubank.Isubank
+	bankKey   string
+	logger    *isulogger.Isulogger
+	loggerKey string
+
+	// fixedBank, fixedLogger が設定されている場合は設定によらずそれを使います
+	fixedBank   *isubank.Isubank
+	fixedLogger *isulogger.Isulogger
+}
+
+var clients = &clientCache{}
+
+// setClients は設定によらず使うクライアントを指定します。nilを指定すると設定から作成したクライアントを使います
+// テストでモックのサーバーに接続する場合に使います
+func setClients(bank *isubank.Isubank, logger *isulogger.Isulogger) {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	clients.fixedBank = bank
+	clients.fixedLogger = logger
 }
 
 func Isubank(d QueryExecutor) (*isubank.Isubank, error) {
+	clients.mu.Lock()
+	fixed := clients.fixedBank
+	clients.mu.Unlock()
+	if fixed != nil {
+		return fixed, nil
+	}
 	ep, err := GetSetting(d, BankEndpoint)
 	if err != nil {
 		return nil, errors.Wrapf(err, "getSetting failed. %s", BankEndpoint)
@@ -43,10 +155,25 @@ func Isubank(d QueryExecutor) (*isubank.Isubank, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "getSetting failed. %s", BankAppid)
 	}
-	return isubank.NewIsubank(ep, id)
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	if key := ep + "\x00" + id; clients.bank == nil || clients.bankKey != key {
+		bank, err := isubank.NewIsubankWithClient(ep, id, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		clients.bank, clients.bankKey = bank, key
+	}
+	return clients.bank, nil
 }
 
 func Logger(d QueryExecutor) (*isulogger.Isulogger, error) {
+	clients.mu.Lock()
+	fixed := clients.fixedLogger
+	clients.mu.Unlock()
+	if fixed != nil {
+		return fixed, nil
+	}
 	ep, err := GetSetting(d, LogEndpoint)
 	if err != nil {
 		return nil, errors.Wrapf(err, "getSetting failed. %s", LogEndpoint)
@@ -55,16 +182,78 @@ func Logger(d QueryExecutor) (*isulogger.Isulogger, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "getSetting failed. %s", LogAppid)
 	}
-	return isulogger.NewIsulogger(ep, id)
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	if key := ep + "\x00" + id; clients.logger == nil || clients.loggerKey != key {
+		logger, err := isulogger.NewIsuloggerWithClient(ep, id, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		clients.logger, clients.loggerKey = logger, key
+	}
+	return clients.logger, nil
+}
+
+// LogShipperOption はログをまとめて送信するShipperの設定です
+var LogShipperOption = isulogger.ShipperOption{}
+
+// logShipper は現在のIsuloggerに対するShipperを保持します
+// 設定が変わりIsuloggerが作り直された場合は、古いShipperの送信待ちのログを送信してから新しいShipperに切り替えます
+type logShipper struct {
+	mu      sync.Mutex
+	logger  *isulogger.Isulogger
+	shipper *isulogger.Shipper
+	closed  bool
+}
+
+var shipper = &logShipper{}
+
+func (s *logShipper) get(logger *isulogger.Isulogger) (*isulogger.Shipper, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, isulogger.ErrShipperClosed
+	}
+	if s.logger != logger {
+		if old := s.shipper; old != nil {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if err := old.Close(ctx); err != nil {
+					log.Printf("[WARN] close log shipper failed. err:%s", err)
+				}
+			}()
+		}
+		s.logger = logger
+		s.shipper = isulogger.NewShipper(logger, LogShipperOption)
+	}
+	return s.shipper, nil
 }
 
-func sendLog(d QueryExecutor, tag string, v interface{}) {
+// CloseLogShipper は送信待ちのログを送信し、以降のログの送信を止めます
+func CloseLogShipper(ctx context.Context) error {
+	shipper.mu.Lock()
+	shipper.closed = true
+	s := shipper.shipper
+	shipper.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Close(ctx)
+}
+
+// sendErrorLog はエラーのログを送信待ちに追加します。送信はバックグラウンドでまとめて行います
+// エラーのログはトランザクションがロールバックされても送信するため、log_outboxを経由しません
+func sendErrorLog(d QueryExecutor, tag string, v interface{}) {
 	logger, err := Logger(d)
 	if err != nil {
 		log.Printf("[WARN] new logger failed. tag: %s, v: %v, err:%s", tag, v, err)
 		return
 	}
-	err = logger.Send(tag, v)
+	s, err := shipper.get(logger)
+	if err == nil {
+		err = s.Send(tag, v)
+	}
 	if err != nil {
 		log.Printf("[WARN] logger send failed. tag: %s, v: %v, err:%s", tag, v, err)
 	}
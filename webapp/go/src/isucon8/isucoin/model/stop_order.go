@@ -0,0 +1,238 @@
+package model
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 逆指値注文の状態
+const (
+	// 発動条件を満たすのを待っている注文
+	StopOrderStatusPending = "pending_trigger"
+	// 発動して通常の注文になった注文。注文のidはorder_idに記録します
+	StopOrderStatusTriggered = "triggered"
+	// 発動前に取り消された、または発動時に注文できなかった注文
+	StopOrderStatusCanceled = "canceled"
+)
+
+// 逆指値注文が発動時に注文できなかった理由
+const (
+	CancelReasonCreditInsufficient = "credit_insufficient"
+	CancelReasonIsuInsufficient    = "isu_insufficient"
+)
+
+// StopOrder は直近の約定価格が逆指値に達したときに通常の注文となる注文です
+// 買い注文は約定価格が逆指値以上、売り注文は約定価格が逆指値以下になると発動します
+// OrderTypeがlimitの場合はPriceを指値とするGTC注文、marketの場合はIOCの成行注文になります
+//
+//go:generate scanner
+type StopOrder struct {
+	ID          int64      `json:"id"`
+	Type        string     `json:"type"`
+	UserID      int64      `json:"user_id"`
+	Amount      int64      `json:"amount"`
+	Price       int64      `json:"price"`
+	StopPrice   int64      `json:"stop_price"`
+	OrderType   string     `json:"order_type"`
+	Status      string     `json:"status"`
+	CloseReason string     `json:"close_reason,omitempty"`
+	OrderID     int64      `json:"order_id,omitempty"`
+	ClosedAt    *time.Time `json:"closed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// triggered は約定価格priceで発動条件を満たすかを返します
+func (s *StopOrder) triggered(price int64) bool {
+	switch s.Type {
+	case OrderTypeBuy:
+		return price >= s.StopPrice
+	case OrderTypeSell:
+		return price <= s.StopPrice
+	}
+	return false
+}
+
+// GetPendingStopOrdersByUserID は条件に合うユーザーの未発動の逆指値注文をid順に返します
+// OrderFilterのうちType, From, Toのみを使います
+func GetPendingStopOrdersByUserID(d QueryExecutor, userID int64, f OrderFilter) ([]*StopOrder, error) {
+	query := "SELECT * FROM stop_orders WHERE user_id = ? AND status = ?"
+	args := []interface{}{userID, StopOrderStatusPending}
+	switch f.Type {
+	case "":
+	case OrderTypeBuy, OrderTypeSell:
+		query += " AND type = ?"
+		args = append(args, f.Type)
+	default:
+		return nil, ErrParameterInvalid
+	}
+	if f.From != nil {
+		query += " AND created_at >= ?"
+		args = append(args, *f.From)
+	}
+	if f.To != nil {
+		query += " AND created_at < ?"
+		args = append(args, *f.To)
+	}
+	return scanStopOrders(d.Query(query+" ORDER BY id ASC", args...))
+}
+
+func getStopOrderByIDWithLock(tx *sql.Tx, id int64) (*StopOrder, error) {
+	return scanStopOrder(tx.Query("SELECT * FROM stop_orders WHERE id = ? FOR UPDATE", id))
+}
+
+// AddStopOrder は逆指値注文を登録します
+// 残高や椅子の保有数は発動時に確認します
+func AddStopOrder(tx *sql.Tx, ot string, userID, amount, price, stopPrice int64, opt OrderOption) (*StopOrder, error) {
+	if opt.TimeInForce != "" || opt.ExpireAt != nil {
+		// 執行条件は注文種別から決まるため指定できない
+		return nil, ErrParameterInvalid
+	}
+	req := OrderRequest{Type: ot, Amount: amount, Price: price, OrderOption: opt}
+	if err := req.normalize(); err != nil {
+		return nil, err
+	}
+	if stopPrice <= 0 {
+		return nil, ErrParameterInvalid
+	}
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	res, err := tx.Exec(`INSERT INTO stop_orders (type, user_id, amount, price, stop_price, order_type, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, NOW(6))`, req.Type, user.ID, req.Amount, req.Price, stopPrice, req.OrderType, StopOrderStatusPending)
+	if err != nil {
+		return nil, errors.Wrap(err, "insert stop_orders failed")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, errors.Wrap(err, "get stop_order_id failed")
+	}
+	if err = sendLog(tx, req.Type+".stop_order", map[string]interface{}{
+		"stop_order_id": id,
+		"user_id":       user.ID,
+		"amount":        req.Amount,
+		"price":         req.Price,
+		"stop_price":    stopPrice,
+	}); err != nil {
+		return nil, err
+	}
+	return scanStopOrder(tx.Query("SELECT * FROM stop_orders WHERE id = ?", id))
+}
+
+// DeleteStopOrder は未発動の逆指値注文を取り消します
+func DeleteStopOrder(tx *sql.Tx, userID, stopOrderID int64, reason string) error {
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	stop, err := getStopOrderByIDWithLock(tx, stopOrderID)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrOrderNotFound
+	case err != nil:
+		return errors.Wrapf(err, "getStopOrderByIDWithLock failed. id:%d", stopOrderID)
+	case stop.UserID != user.ID:
+		return ErrOrderNotFound
+	case stop.Status != StopOrderStatusPending:
+		return ErrOrderAlreadyClosed
+	}
+	return cancelStopOrder(tx, stop, reason)
+}
+
+func cancelStopOrder(d QueryExecutor, stop *StopOrder, reason string) error {
+	if _, err := d.Exec(`UPDATE stop_orders SET status = ?, close_reason = ?, closed_at = NOW(6) WHERE id = ?`, StopOrderStatusCanceled, reason, stop.ID); err != nil {
+		return errors.Wrap(err, "update stop_orders for cancel")
+	}
+	return sendLog(d, stop.Type+".stop_delete", map[string]interface{}{
+		"stop_order_id": stop.ID,
+		"user_id":       stop.UserID,
+		"reason":        reason,
+	})
+}
+
+// RunStopOrders は直近の約定価格で発動条件を満たした逆指値注文を通常の注文にし、発動した件数を返します
+// 発動したIOC注文はその場で取引します。GTC注文の取引は呼び出し側でRunTradeを行ってください
+// 発動に失敗した逆指値注文はログに出力して読み飛ばし、発動した件数に含めません
+func RunStopOrders(db *sql.DB) (int, error) {
+	trade, err := GetLatestTrade(db)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "GetLatestTrade failed")
+	}
+	stops, err := scanStopOrders(db.Query(`SELECT * FROM stop_orders WHERE status = ? AND ((type = ? AND stop_price <= ?) OR (type = ? AND stop_price >= ?)) ORDER BY id ASC`,
+		StopOrderStatusPending, OrderTypeBuy, trade.Price, OrderTypeSell, trade.Price))
+	if err != nil {
+		return 0, errors.Wrap(err, "find triggered stop_orders failed")
+	}
+	n := 0
+	for _, stop := range stops {
+		order, err := triggerStopOrderTx(db, stop.ID, trade.Price)
+		if err != nil {
+			// 1件の失敗で他の逆指値注文の発動を止めないよう、未発動のまま次回に再試行する
+			log.Printf("[WARN] triggerStopOrder failed. id:%d err:%s", stop.ID, err)
+			continue
+		}
+		n++
+		if order != nil && order.IsImmediate() {
+			if err = RunImmediateOrder(db, order.ID); err != nil {
+				log.Printf("[WARN] RunImmediateOrder failed. id:%d err:%s", order.ID, err)
+			}
+		}
+	}
+	return n, nil
+}
+
+// triggerStopOrderTx は逆指値注文を発動し、作成した注文を返します
+// 既に発動済みまたは取り消し済みの場合や、注文できずに取り消した場合はnilを返します
+func triggerStopOrderTx(db *sql.DB, stopOrderID, price int64) (order *Order, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "begin transaction failed")
+	}
+	order, err = triggerStopOrder(tx, stopOrderID, price)
+	if err != nil {
+		RollbackTx(tx)
+		return nil, err
+	}
+	if err = CommitTx(tx); err != nil {
+		return nil, errors.Wrap(err, "commit failed")
+	}
+	PublishBestPrice()
+	return order, nil
+}
+
+func triggerStopOrder(tx *sql.Tx, stopOrderID, price int64) (*Order, error) {
+	stop, err := getStopOrderByIDWithLock(tx, stopOrderID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getStopOrderByIDWithLock failed. id:%d", stopOrderID)
+	}
+	if stop.Status != StopOrderStatusPending || !stop.triggered(price) {
+		return nil, nil
+	}
+	order, err := AddOrder(tx, stop.Type, stop.UserID, stop.Amount, stop.Price, OrderOption{OrderType: stop.OrderType})
+	switch {
+	case err == ErrCreditInsufficient:
+		return nil, cancelStopOrder(tx, stop, CancelReasonCreditInsufficient)
+	case err == ErrIsuInsufficient:
+		return nil, cancelStopOrder(tx, stop, CancelReasonIsuInsufficient)
+	case err != nil:
+		return nil, errors.Wrapf(err, "AddOrder failed. stop_order_id:%d", stop.ID)
+	}
+	if _, err = tx.Exec(`UPDATE stop_orders SET status = ?, order_id = ?, closed_at = NOW(6) WHERE id = ?`, StopOrderStatusTriggered, order.ID, stop.ID); err != nil {
+		return nil, errors.Wrap(err, "update stop_orders for trigger")
+	}
+	if err = sendLog(tx, stop.Type+".stop_trigger", map[string]interface{}{
+		"stop_order_id": stop.ID,
+		"order_id":      order.ID,
+		"user_id":       stop.UserID,
+		"stop_price":    stop.StopPrice,
+		"trade_price":   price,
+	}); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
@@ -0,0 +1,222 @@
+package model
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ストリームで配信するイベントの種類
+const (
+	StreamEventTrade  = "trade"
+	StreamEventBest   = "best"
+	StreamEventCandle = "candle"
+	StreamEventFill   = "fill"
+)
+
+// streamBufferSize は購読者ごとに溜めておけるイベントの数です
+// 受信が追いつかずにこれを超えた購読者は切断します
+const streamBufferSize = 256
+
+type StreamEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+
+	// userID が0以外の場合はそのユーザーにのみ配信します
+	userID int64
+}
+
+type BestPrice struct {
+	LowestSellPrice int64 `json:"lowest_sell_price,omitempty"`
+	HighestBuyPrice int64 `json:"highest_buy_price,omitempty"`
+}
+
+type CandleUpdate struct {
+	Resolution string           `json:"resolution"`
+	Candle     *CandlestickData `json:"candle"`
+}
+
+type Fill struct {
+	OrderID int64  `json:"order_id"`
+	TradeID int64  `json:"trade_id"`
+	Type    string `json:"type"`
+	Price   int64  `json:"price"`
+	Amount  int64  `json:"amount"`
+	Fee     int64  `json:"fee"`
+}
+
+// Subscription はストリームの購読です
+// Cはイベントを受け取るチャネルで、購読が終了すると閉じられます
+type Subscription struct {
+	C      <-chan StreamEvent
+	c      chan StreamEvent
+	userID int64
+}
+
+// streamBroker はトレードの成立などのイベントを購読者に配信します
+// トランザクション中に発生したイベントはコミットされるまで配信しません
+type streamBroker struct {
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	pending map[*sql.Tx][]StreamEvent
+	best    BestPrice
+	closed  bool
+}
+
+var stream = &streamBroker{
+	subs:    make(map[*Subscription]struct{}),
+	pending: make(map[*sql.Tx][]StreamEvent),
+}
+
+// Subscribe はストリームを購読します。userIDが0の場合は公開イベントのみを受け取ります
+func Subscribe(userID int64) *Subscription {
+	c := make(chan StreamEvent, streamBufferSize)
+	s := &Subscription{C: c, c: c, userID: userID}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.closed {
+		close(c)
+		return s
+	}
+	stream.subs[s] = struct{}{}
+	return s
+}
+
+// Close は購読を終了します
+func (s *Subscription) Close() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.unsubscribeLocked(s)
+}
+
+// CloseStreams は全ての購読を終了し、以降の購読を受け付けません
+func CloseStreams() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	for s := range stream.subs {
+		stream.unsubscribeLocked(s)
+	}
+	stream.closed = true
+}
+
+func (b *streamBroker) unsubscribeLocked(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+func (b *streamBroker) hasSubscribers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *streamBroker) publishLocked(events []StreamEvent) {
+	for s := range b.subs {
+	send:
+		for _, ev := range events {
+			if ev.userID != 0 && ev.userID != s.userID {
+				continue
+			}
+			select {
+			case s.c <- ev:
+			default:
+				// 受信が追いつかない購読者は切断し、再接続時に/infoで同期してもらう
+				log.Printf("[INFO] drop slow stream subscriber. user_id:%d", s.userID)
+				b.unsubscribeLocked(s)
+				break send
+			}
+		}
+	}
+}
+
+// add はトランザクションのコミット後に配信するイベントを登録します
+func (b *streamBroker) add(tx *sql.Tx, events ...StreamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[tx] = append(b.pending[tx], events...)
+}
+
+// commit はトランザクションで発生したイベントを配信します
+func (b *streamBroker) commit(tx *sql.Tx) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	events := b.pending[tx]
+	delete(b.pending, tx)
+	b.publishLocked(events)
+}
+
+// discard はロールバックしたトランザクションで発生したイベントを破棄します
+func (b *streamBroker) discard(tx *sql.Tx) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, tx)
+}
+
+// PublishBestPrice は板の最良気配が前回の配信から変わっていれば配信します
+func PublishBestPrice() {
+	var best BestPrice
+	if o := book.best(OrderTypeSell); o != nil {
+		best.LowestSellPrice = o.Price
+	}
+	if o := book.best(OrderTypeBuy); o != nil {
+		best.HighestBuyPrice = o.Price
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if best == stream.best {
+		return
+	}
+	stream.best = best
+	stream.publishLocked([]StreamEvent{{Type: StreamEventBest, Data: best}})
+}
+
+// addTradeEvents はトレードの成立と更新された足、注文の約定をコミット後の配信に登録します
+func addTradeEvents(tx *sql.Tx, tradeID int64, fills []tradeFill) error {
+	if !stream.hasSubscribers() {
+		return nil
+	}
+	trade, err := GetTradeByID(tx, tradeID)
+	if err != nil {
+		return errors.Wrapf(err, "GetTradeByID failed. id:%d", tradeID)
+	}
+	events := []StreamEvent{{Type: StreamEventTrade, Data: trade}}
+	for _, r := range candlestickResolutions {
+		candle, err := getCandlestick(tx, r, trade.CreatedAt)
+		if err != nil {
+			return err
+		}
+		events = append(events, StreamEvent{
+			Type: StreamEventCandle,
+			Data: CandleUpdate{Resolution: r.name, Candle: candle},
+		})
+	}
+	for _, f := range fills {
+		events = append(events, StreamEvent{
+			Type: StreamEventFill,
+			Data: Fill{
+				OrderID: f.order.ID,
+				TradeID: tradeID,
+				Type:    f.order.Type,
+				Price:   trade.Price,
+				Amount:  f.amount,
+				Fee:     f.fee,
+			},
+			userID: f.order.UserID,
+		})
+	}
+	stream.add(tx, events...)
+	return nil
+}
+
+func getCandlestick(d QueryExecutor, r candlestickResolution, t time.Time) (*CandlestickData, error) {
+	candle, err := scanCandlestickData(d.Query("SELECT "+candlestickColumns+" FROM candlestick WHERE resolution = ? AND t = ?", r.name, r.truncate(t)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "find candlestick failed. resolution:%s", r.name)
+	}
+	return candle, nil
+}
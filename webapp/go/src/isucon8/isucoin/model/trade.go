@@ -1,8 +1,8 @@
 package model
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"isucon8/isubank"
 	"log"
 	"time"
@@ -10,6 +10,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// TradeReserveTimeout は1回の取引でいすこん銀行に仮決済、確定、取り消しするリクエスト全体の期限です
+// 注文をロックしたまま銀行の応答を待ち続けないようにします
+var TradeReserveTimeout = 3 * time.Second
+
 //go:generate scanner
 type Trade struct {
 	ID        int64     `json:"id"`
@@ -20,111 +24,150 @@ type Trade struct {
 
 //go:generate scanner
 type CandlestickData struct {
-	Time  time.Time `json:"time"`
-	Open  int64     `json:"open"`
-	Close int64     `json:"close"`
-	High  int64     `json:"high"`
-	Low   int64     `json:"low"`
+	Time       time.Time `json:"time"`
+	Open       int64     `json:"open"`
+	Close      int64     `json:"close"`
+	High       int64     `json:"high"`
+	Low        int64     `json:"low"`
+	Volume     int64     `json:"volume"`
+	TradeCount int64     `json:"trade_count"`
+	VWAP       float64   `json:"vwap"`
 }
 
 func GetTradeByID(d QueryExecutor, id int64) (*Trade, error) {
 	return scanTrade(d.Query("SELECT * FROM trade WHERE id = ?", id))
 }
 
-func GetLatestTrade(d QueryExecutor) (*Trade, error) {
-	return scanTrade(d.Query("SELECT * FROM trade ORDER BY id DESC"))
-}
-
-func GetCandlestickData(d QueryExecutor, mt time.Time, tf string) ([]*CandlestickData, error) {
-	query := fmt.Sprintf(`
-		SELECT m.t, a.price, b.price, m.h, m.l
-		FROM (
-			SELECT
-				STR_TO_DATE(DATE_FORMAT(created_at, '%s'), '%s') AS t,
-				MIN(id) AS min_id,
-				MAX(id) AS max_id,
-				MAX(price) AS h,
-				MIN(price) AS l
-			FROM trade
-			WHERE created_at >= ?
-			GROUP BY t
-		) m
-		JOIN trade a ON a.id = m.min_id
-		JOIN trade b ON b.id = m.max_id
-		ORDER BY m.t
-	`, tf, "%Y-%m-%d %H:%i:%s")
-	return scanCandlestickDatas(d.Query(query, mt))
-}
-
-func HasTradeChanceByOrder(d QueryExecutor, orderID int64) (bool, error) {
-	order, err := GetOrderByID(d, orderID)
+func getTradesByIDs(d QueryExecutor, ids []int64) (map[int64]*Trade, error) {
+	res := make(map[int64]*Trade, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	query, args := inQuery("SELECT * FROM trade WHERE id IN (%s)", ids)
+	trades, err := scanTrades(d.Query(query, args...))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	lowest, err := GetLowestSellOrder(d)
-	switch {
-	case err == sql.ErrNoRows:
-		return false, nil
-	case err != nil:
-		return false, errors.Wrap(err, "GetLowestSellOrder")
+	for _, t := range trades {
+		res[t.ID] = t
 	}
+	return res, nil
+}
 
-	highest, err := GetHighestBuyOrder(d)
-	switch {
-	case err == sql.ErrNoRows:
-		return false, nil
-	case err != nil:
-		return false, errors.Wrap(err, "GetHighestBuyOrder")
+func GetLatestTrade(d QueryExecutor) (*Trade, error) {
+	return scanTrade(d.Query("SELECT * FROM trade ORDER BY id DESC"))
+}
+
+func HasTradeChanceByOrder(orderID int64) bool {
+	order := book.get(orderID)
+	if order == nil {
+		return false
 	}
 
 	switch order.Type {
 	case OrderTypeBuy:
-		if lowest.Price <= order.Price {
-			return true, nil
+		if lowest := book.best(OrderTypeSell); lowest != nil && lowest.Price <= order.Price {
+			return true
 		}
 	case OrderTypeSell:
-		if order.Price <= highest.Price {
-			return true, nil
+		if highest := book.best(OrderTypeBuy); highest != nil && order.Price <= highest.Price {
+			return true
 		}
-	default:
-		return false, errors.Errorf("other type [%s]", order.Type)
 	}
-	return false, nil
+	return false
 }
 
-func reserveOrder(d QueryExecutor, order *Order, price int64) (int64, error) {
-	bank, err := Isubank(d)
+// reservePrice は注文の取引金額から手数料feeを差し引いた仮決済の金額を返します
+// 買い注文は取引金額に手数料を加えた額を支払い、売り注文は手数料を差し引いた額を受け取ります
+func reservePrice(order *Order, amount, price, fee int64) int64 {
+	if order.Type == OrderTypeBuy {
+		return -(amount*price + fee)
+	}
+	return amount*price - fee
+}
+
+// cancelUnreservedOrder は残高不足で仮決済できなかった注文を取り消します
+func cancelUnreservedOrder(tx *sql.Tx, f tradeFill, price int64, cause error) error {
+	if err := cancelOrder(tx, f.order, CancelReasonReserveFailed); err != nil {
+		return err
+	}
+	sendErrorLog(tx, f.order.Type+".error", map[string]interface{}{
+		"error":   cause.Error(),
+		"user_id": f.order.UserID,
+		"amount":  f.amount,
+		"price":   price,
+	})
+	return nil
+}
+
+// reserveTrade は相手注文、注文、取引所が受け取る手数料の仮決済を1回のリクエストでまとめて行い、成功した仮決済のIDを返します
+// 残高不足の注文は取り消します。相手注文を取り消した場合は相手注文を選び直すためretryをtrueにし、
+// 注文を取り消した場合はErrCreditInsufficientを返します
+func reserveTrade(ctx context.Context, tx *sql.Tx, fees *FeeSchedule, taker tradeFill, makers []tradeFill, price int64) (reserves []int64, retry bool, err error) {
+	bank, err := Isubank(tx)
 	if err != nil {
-		return 0, errors.Wrap(err, "isubank init failed")
+		return nil, false, errors.Wrap(err, "isubank init failed")
 	}
-	p := order.Amount * price
-	if order.Type == OrderTypeBuy {
-		p *= -1
+	fills := append(makers[:len(makers):len(makers)], taker)
+	reqs := make([]isubank.ReserveRequest, 0, len(fills)+1)
+	totalFee := int64(0)
+	for _, f := range fills {
+		reqs = append(reqs, isubank.ReserveRequest{
+			BankID: f.order.User.BankID,
+			Price:  reservePrice(f.order, f.amount, price, f.fee),
+		})
+		totalFee += f.fee
+	}
+	if totalFee > 0 {
+		// 手数料は取引所のアカウントに入金する
+		reqs = append(reqs, isubank.ReserveRequest{BankID: fees.BankID, Price: totalFee})
 	}
 
-	id, err := bank.Reserve(order.User.BankID, p)
+	results, err := bank.ReserveBulkContext(ctx, reqs, false)
 	if err != nil {
-		if err == isubank.ErrCreditInsufficient {
-			if derr := cancelOrder(d, order, "reserve_failed"); derr != nil {
-				return 0, derr
+		return nil, false, errors.Wrap(err, "isubank.ReserveBulk")
+	}
+	reserves = make([]int64, 0, len(results))
+	for _, r := range results {
+		if r.Err == nil {
+			reserves = append(reserves, r.ReserveID)
+		}
+	}
+	for i, f := range fills {
+		switch err := results[i].Err; {
+		case err == nil:
+		case !isubank.IsCreditInsufficient(err):
+			return reserves, false, errors.Wrapf(err, "isubank.ReserveBulk. order_id:%d", f.order.ID)
+		case i < len(makers):
+			if err = cancelUnreservedOrder(tx, f, price, err); err != nil {
+				return reserves, false, err
 			}
-			sendLog(d, order.Type+".error", map[string]interface{}{
-				"error":   err.Error(),
-				"user_id": order.UserID,
-				"amount":  order.Amount,
-				"price":   price,
-			})
-			return 0, err
+			retry = true
+		case !retry:
+			// 相手注文を選び直す場合は注文の仮決済の金額も変わるため、注文の残高不足は選び直してから扱う
+			if err = cancelUnreservedOrder(tx, f, price, err); err != nil {
+				return reserves, false, err
+			}
+			return reserves, false, ErrCreditInsufficient
+		}
+	}
+	if totalFee > 0 {
+		if err = results[len(fills)].Err; err != nil {
+			return reserves, false, errors.Wrap(err, "isubank.ReserveBulk for fee")
 		}
-		return 0, errors.Wrap(err, "isubank.Reserve")
 	}
+	return reserves, retry, nil
+}
 
-	return id, nil
+// tradeFill は取引において注文のうち成立させる脚数です
+type tradeFill struct {
+	order  *Order
+	amount int64
+	fee    int64
 }
 
-func commitReservedOrder(tx *sql.Tx, order *Order, targets []*Order, reserves []int64) error {
-	res, err := tx.Exec(`INSERT INTO trade (amount, price, created_at) VALUES (?, ?, NOW(6))`, order.Amount, order.Price)
+func commitReservedOrder(ctx context.Context, tx *sql.Tx, taker tradeFill, makers []tradeFill, price int64, reserves []int64) error {
+	res, err := tx.Exec(`INSERT INTO trade (amount, price, created_at) VALUES (?, ?, NOW(6))`, taker.amount, price)
 	if err != nil {
 		return errors.Wrap(err, "insert trade")
 	}
@@ -132,104 +175,189 @@ func commitReservedOrder(tx *sql.Tx, order *Order, targets []*Order, reserves []
 	if err != nil {
 		return errors.Wrap(err, "lastInsertID for trade")
 	}
-	sendLog(tx, "trade", map[string]interface{}{
+	if err = addCandlestick(tx, tradeID); err != nil {
+		return err
+	}
+	if err = sendLog(tx, "trade", map[string]interface{}{
 		"trade_id": tradeID,
-		"price":    order.Price,
-		"amount":   order.Amount,
-	})
-	for _, o := range append(targets, order) {
-		if _, err = tx.Exec(`UPDATE orders SET trade_id = ?, closed_at = NOW(6) WHERE id = ?`, tradeID, o.ID); err != nil {
+		"price":    price,
+		"amount":   taker.amount,
+	}); err != nil {
+		return err
+	}
+	for _, f := range append(makers, taker) {
+		o := f.order
+		if o.FilledAmount+f.amount >= o.Amount {
+			_, err = tx.Exec(`UPDATE orders SET filled_amount = filled_amount + ?, fee = fee + ?, trade_id = ?, status = ?, closed_at = NOW(6) WHERE id = ?`, f.amount, f.fee, tradeID, OrderStatusTraded, o.ID)
+		} else {
+			_, err = tx.Exec(`UPDATE orders SET filled_amount = filled_amount + ?, fee = fee + ?, trade_id = ? WHERE id = ?`, f.amount, f.fee, tradeID, o.ID)
+		}
+		if err != nil {
 			return errors.Wrap(err, "update order for trade")
 		}
-		sendLog(tx, o.Type+".trade", map[string]interface{}{
+		if _, err = tx.Exec(`INSERT INTO order_fill (order_id, trade_id, amount, fee, created_at) VALUES (?, ?, ?, ?, NOW(6))`, o.ID, tradeID, f.amount, f.fee); err != nil {
+			return errors.Wrap(err, "insert order_fill")
+		}
+		if err = addIsuLedger(tx, o, tradeID, f.amount); err != nil {
+			return errors.Wrap(err, "insert isu_ledger")
+		}
+		book.fill(tx, o.ID, f.amount)
+		if err = sendLog(tx, o.Type+".trade", map[string]interface{}{
 			"order_id": o.ID,
-			"price":    order.Price,
-			"amount":   o.Amount,
+			"price":    price,
+			"amount":   f.amount,
+			"fee":      f.fee,
 			"user_id":  o.UserID,
 			"trade_id": tradeID,
-		})
+		}); err != nil {
+			return err
+		}
+	}
+	if err = addTradeEvents(tx, tradeID, append(makers, taker)); err != nil {
+		return err
 	}
 	bank, err := Isubank(tx)
 	if err != nil {
 		return errors.Wrap(err, "isubank init failed")
 	}
-	if err = bank.Commit(reserves); err != nil {
+	if err = bank.CommitContext(ctx, reserves); err != nil {
 		return errors.Wrap(err, "commit")
 	}
 	return nil
 }
 
-func tryTrade(tx *sql.Tx, orderID int64) error {
+// lockOpenOrder は注文をロックして取得します
+// 既に成立またはキャンセルされている場合は板からも取り除き、有効期限を過ぎている場合は取り消します
+func lockOpenOrder(tx *sql.Tx, orderID int64) (*Order, error) {
 	order, err := getOpenOrderByID(tx, orderID)
-	if err != nil {
-		return err
+	switch {
+	case err == ErrOrderAlreadyClosed:
+		book.remove(tx, orderID)
+		return nil, err
+	case errors.Cause(err) == sql.ErrNoRows:
+		book.remove(tx, orderID)
+		return nil, ErrOrderAlreadyClosed
+	case err != nil:
+		return nil, err
+	}
+	if order.isExpired(time.Now()) {
+		if err = cancelOrder(tx, order, CancelReasonExpired); err != nil {
+			return nil, err
+		}
+		return nil, ErrOrderAlreadyClosed
+	}
+	return order, nil
+}
+
+// selectMakers は優先順位順に相手注文をロックし、注文の残りの脚数まで成立させる相手注文と、成立しない脚数を返します
+func selectMakers(tx *sql.Tx, targetIDs []int64, restAmount int64) ([]tradeFill, int64, error) {
+	makers := make([]tradeFill, 0, 8)
+	for _, targetID := range targetIDs {
+		to, err := lockOpenOrder(tx, targetID)
+		if err != nil {
+			if err == ErrOrderAlreadyClosed {
+				continue
+			}
+			return nil, 0, errors.Wrap(err, "getOpenOrderByID  buy_order")
+		}
+		// 相手注文の脚数が多い場合は一部のみを成立させる
+		amount := to.RemainingAmount()
+		if amount > restAmount {
+			amount = restAmount
+		}
+		makers = append(makers, tradeFill{order: to, amount: amount})
+		restAmount -= amount
+		if restAmount == 0 {
+			break
+		}
 	}
+	return makers, restAmount, nil
+}
 
-	restAmount := order.Amount
-	unitPrice := order.Price
-	reserves := make([]int64, 1, order.Amount+1)
-	targets := make([]*Order, 0, order.Amount)
+func cancelReserves(ctx context.Context, d QueryExecutor, reserves []int64) {
+	bank, err := Isubank(d)
+	if err != nil {
+		log.Printf("[WARN] isubank init failed. err:%s", err)
+		return
+	}
+	if err = bank.CancelContext(ctx, reserves); err != nil {
+		log.Printf("[WARN] isubank cancel failed. err:%s", err)
+	}
+}
 
-	reserves[0], err = reserveOrder(tx, order, unitPrice)
+func tryTrade(tx *sql.Tx, orderID int64) error {
+	order, err := lockOpenOrder(tx, orderID)
 	if err != nil {
 		return err
 	}
+
+	limit := order.Price
+	if order.OrderType == OrderTypeMarket {
+		// 成行注文は板から見込まれる最も不利な価格を指値とする
+		if limit = book.sweepPrice(order.Type, order.RemainingAmount()); limit == 0 {
+			return ErrNoOrderForTrade
+		}
+	}
+	fees, err := GetFeeSchedule(tx)
+	if err != nil {
+		return errors.Wrap(err, "GetFeeSchedule failed")
+	}
+	var reserves []int64
+	ctx, cancel := context.WithTimeout(context.Background(), TradeReserveTimeout)
+	defer cancel()
+
 	defer func() {
 		if len(reserves) > 0 {
-			bank, err := Isubank(tx)
-			if err != nil {
-				log.Printf("[WARN] isubank init failed. err:%s", err)
-				return
-			}
-			if err = bank.Cancel(reserves); err != nil {
-				log.Printf("[WARN] isubank cancel failed. err:%s", err)
-			}
+			cancelReserves(ctx, tx, reserves)
 		}
 	}()
 
-	var targetOrders []*Order
-	switch order.Type {
-	case OrderTypeBuy:
-		targetOrders, err = scanOrders(tx.Query(`SELECT * FROM orders WHERE type = ? AND closed_at IS NULL AND price <= ? ORDER BY price ASC, created_at ASC, id ASC`, OrderTypeSell, order.Price))
-	case OrderTypeSell:
-		targetOrders, err = scanOrders(tx.Query(`SELECT * FROM orders WHERE type = ? AND closed_at IS NULL AND price >= ? ORDER BY price DESC, created_at ASC, id ASC`, OrderTypeBuy, order.Price))
-	}
-	if err != nil {
-		return errors.Wrap(err, "find target orders")
-	}
-	if len(targetOrders) == 0 {
+	targetIDs := book.matchable(order, limit)
+	if len(targetIDs) == 0 {
 		return ErrNoOrderForTrade
 	}
 
-	for _, to := range targetOrders {
-		to, err = getOpenOrderByID(tx, to.ID)
+	var (
+		makers     []tradeFill
+		taker      tradeFill
+		restAmount int64
+		unitPrice  int64
+	)
+	for {
+		makers, restAmount, err = selectMakers(tx, targetIDs, order.RemainingAmount())
 		if err != nil {
-			if err == ErrOrderAlreadyClosed {
-				continue
-			}
-			return errors.Wrap(err, "getOpenOrderByID  buy_order")
+			return err
 		}
-		if to.Amount > restAmount {
-			continue
+		if len(makers) == 0 {
+			return ErrNoOrderForTrade
 		}
-		rid, err := reserveOrder(tx, to, unitPrice)
-		if err != nil {
-			if err == isubank.ErrCreditInsufficient {
-				continue
-			}
+		if restAmount > 0 && order.TimeInForce == TimeInForceFOK {
+			return ErrNoOrderForTrade
+		}
+
+		// 同一取引の単価は全て同じでなければならない
+		unitPrice = ExecutionPricePolicy(limit, restingPrice(order.Type, makers))
+		if err = validateTradePrice(order.Type, limit, makers, unitPrice); err != nil {
 			return err
 		}
-		reserves = append(reserves, rid)
-		targets = append(targets, to)
-		restAmount -= to.Amount
-		if restAmount == 0 {
+		// 注文の脚数が多い場合は成立した分だけを取引する
+		taker = tradeFill{order: order, amount: order.RemainingAmount() - restAmount}
+		fees.setFees(&taker, makers, unitPrice)
+		var retry bool
+		if reserves, retry, err = reserveTrade(ctx, tx, fees, taker, makers, unitPrice); err != nil {
+			return err
+		}
+		if !retry {
 			break
 		}
+		// 予約できなかった相手注文は取り消されているため、相手注文を選び直して単価を決め直す
+		if len(reserves) > 0 {
+			cancelReserves(ctx, tx, reserves)
+		}
+		reserves = reserves[:0]
 	}
-	if restAmount > 0 {
-		return ErrNoOrderForTrade
-	}
-	if err = commitReservedOrder(tx, order, targets, reserves); err != nil {
+
+	if err = commitReservedOrder(ctx, tx, taker, makers, unitPrice, reserves); err != nil {
 		return err
 	}
 	reserves = reserves[:0]
@@ -237,22 +365,16 @@ func tryTrade(tx *sql.Tx, orderID int64) error {
 }
 
 func RunTrade(db *sql.DB) error {
-	lowestSellOrder, err := GetLowestSellOrder(db)
-	switch {
-	case err == sql.ErrNoRows:
+	lowestSellOrder := book.best(OrderTypeSell)
+	if lowestSellOrder == nil {
 		// 売り注文が無いため成立しない
 		return nil
-	case err != nil:
-		return errors.Wrap(err, "GetLowestSellOrder")
 	}
 
-	highestBuyOrder, err := GetHighestBuyOrder(db)
-	switch {
-	case err == sql.ErrNoRows:
+	highestBuyOrder := book.best(OrderTypeBuy)
+	if highestBuyOrder == nil {
 		// 買い注文が無いため成立しない
 		return nil
-	case err != nil:
-		return errors.Wrap(err, "GetHighestBuyOrder")
 	}
 
 	if lowestSellOrder.Price > highestBuyOrder.Price {
@@ -260,34 +382,22 @@ func RunTrade(db *sql.DB) error {
 		return nil
 	}
 
+	// 後から注文された方が板の注文と取引する
 	candidates := make([]int64, 0, 2)
-	if lowestSellOrder.Amount > highestBuyOrder.Amount {
-		candidates = append(candidates, lowestSellOrder.ID, highestBuyOrder.ID)
-	} else {
+	if orderBefore(lowestSellOrder, highestBuyOrder) {
 		candidates = append(candidates, highestBuyOrder.ID, lowestSellOrder.ID)
+	} else {
+		candidates = append(candidates, lowestSellOrder.ID, highestBuyOrder.ID)
 	}
 
 	for _, orderID := range candidates {
-		err := func() error {
-			tx, err := db.Begin()
-			if err != nil {
-				return errors.Wrap(err, "begin transaction failed")
-			}
-			err = tryTrade(tx, orderID)
-			switch err {
-			case nil, ErrNoOrderForTrade, ErrOrderAlreadyClosed, isubank.ErrCreditInsufficient:
-				tx.Commit()
-			default:
-				tx.Rollback()
-			}
-			return err
-		}()
+		err := tradeTx(db, orderID)
 		switch err {
 		case nil:
 			// トレード成立したため次の取引を行う
 			return RunTrade(db)
 		case ErrNoOrderForTrade, ErrOrderAlreadyClosed:
-			// 注文個数の多い方で成立しなかったので少ない方で試す
+			// 後から注文された方で成立しなかったので先に注文された方で試す
 			continue
 		default:
 			return err
@@ -296,3 +406,59 @@ func RunTrade(db *sql.DB) error {
 	// 個数のが不足していて不成立
 	return nil
 }
+
+// tradeTx は注文を1つのトランザクションで取引します
+func tradeTx(db *sql.DB, orderID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction failed")
+	}
+	err = tryTrade(tx, orderID)
+	switch err {
+	case nil, ErrNoOrderForTrade, ErrOrderAlreadyClosed, ErrCreditInsufficient:
+		if cerr := CommitTx(tx); cerr != nil {
+			if err == nil {
+				err = errors.Wrap(cerr, "commit failed")
+			}
+			return err
+		}
+		PublishBestPrice()
+	default:
+		RollbackTx(tx)
+	}
+	return err
+}
+
+// RunImmediateOrder はIOC/FOK注文を即時に取引し、成立しなかった分を取り消します
+func RunImmediateOrder(db *sql.DB, orderID int64) error {
+	terr := tradeTx(db, orderID)
+	switch terr {
+	case nil, ErrNoOrderForTrade, ErrOrderAlreadyClosed, ErrCreditInsufficient:
+		terr = nil
+	}
+
+	// 取引に失敗した場合でも注文を残してはいけないので取り消す
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction failed")
+	}
+	order, err := getOrderByIDWithLock(tx, orderID)
+	if err != nil {
+		RollbackTx(tx)
+		return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", orderID)
+	}
+	if order.ClosedAt == nil {
+		reason := CancelReasonIOC
+		if order.TimeInForce == TimeInForceFOK {
+			reason = CancelReasonFOK
+		}
+		if err = cancelOrder(tx, order, reason); err != nil {
+			RollbackTx(tx)
+			return err
+		}
+	}
+	if err = CommitTx(tx); err != nil {
+		return errors.Wrap(err, "commit failed")
+	}
+	return terr
+}
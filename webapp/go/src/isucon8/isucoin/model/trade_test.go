@@ -0,0 +1,245 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"isucon8/isubank"
+	"isucon8/isulogger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testDB はwebapp/sql/isucoin.sqlでテーブルを作成したデータベースに接続します
+// 環境変数 ISUCOIN_TEST_DSN (例: isucon:isucon@tcp(127.0.0.1:3306)/isucoin_test?parseTime=true&loc=Local) が無い場合はテストをスキップします
+// 全てのテーブルを空にするため、データベース名が _test で終わらない場合は失敗します
+// いすこん銀行とISULOGGERはモックのサーバーに接続します
+// テストの終了時に返した関数を呼んでください
+func testDB(t *testing.T) (*sql.DB, func()) {
+	dsn := os.Getenv("ISUCOIN_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ISUCOIN_TEST_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("mysql connect failed. err:%s", err)
+	}
+	var name sql.NullString
+	if err = db.QueryRow("SELECT DATABASE()").Scan(&name); err != nil {
+		db.Close()
+		t.Fatalf("select database failed. err:%s", err)
+	}
+	if !strings.HasSuffix(name.String, "_test") {
+		db.Close()
+		t.Fatalf("ISUCOIN_TEST_DSN must point to a dedicated database whose name ends with _test. database:%q", name.String)
+	}
+	for _, table := range []string{"orders", "stop_orders", "order_fill", "trade", "candlestick", "isu_ledger", "user", "setting", "log_outbox"} {
+		if _, err = db.Exec("DELETE FROM " + table); err != nil {
+			db.Close()
+			t.Fatalf("delete %s failed. err:%s", table, err)
+		}
+	}
+	InvalidateSettings()
+	if err = InitOrderBook(db); err != nil {
+		db.Close()
+		t.Fatalf("InitOrderBook failed. err:%s", err)
+	}
+
+	bank := httptest.NewServer(testBankHandler())
+	logger := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	cleanup := func() {
+		setClients(nil, nil)
+		bank.Close()
+		logger.Close()
+		db.Close()
+	}
+	b, err := isubank.NewIsubank(bank.URL, "test")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	l, err := isulogger.NewIsulogger(logger.URL, "test")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	setClients(b, l)
+	return db, cleanup
+}
+
+// testBankHandler は全ての仮決済に成功するいすこん銀行です
+func testBankHandler() http.Handler {
+	var reserveID int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/reserve_bulk":
+			var req struct {
+				Reserves []isubank.ReserveRequest `json:"reserves"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"bad request"}`))
+				return
+			}
+			results := make([]map[string]interface{}, len(req.Reserves))
+			for i := range req.Reserves {
+				results[i] = map[string]interface{}{"status": 200, "reserve_id": atomic.AddInt64(&reserveID, 1)}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+}
+
+func testUser(t *testing.T, db *sql.DB, bankID string, isu int64) int64 {
+	res, err := db.Exec(`INSERT INTO user (bank_id, name, password, created_at) VALUES (?, ?, '', NOW(6))`, bankID, bankID)
+	if err != nil {
+		t.Fatalf("insert user failed. err:%s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`INSERT INTO isu_ledger (user_id, order_id, trade_id, amount, created_at) VALUES (?, 0, 0, ?, NOW(6))`, id, isu); err != nil {
+		t.Fatalf("insert isu_ledger failed. err:%s", err)
+	}
+	return id
+}
+
+func testAddOrder(t *testing.T, db *sql.DB, ot string, userID, amount, price int64, opt OrderOption) *Order {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := AddOrder(tx, ot, userID, amount, price, opt)
+	if err != nil {
+		RollbackTx(tx)
+		t.Fatalf("AddOrder failed. err:%s", err)
+	}
+	if err = CommitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func testGetOrder(t *testing.T, db *sql.DB, id int64) *Order {
+	order, err := GetOrderByID(db, id)
+	if err != nil {
+		t.Fatalf("GetOrderByID failed. id:%d err:%s", id, err)
+	}
+	if err = FetchOrderRelation(db, order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func filledByFills(o *Order) int64 {
+	var amount int64
+	for _, f := range o.Fills {
+		amount += f.Amount
+	}
+	return amount
+}
+
+func TestPartialFill(t *testing.T) {
+	db, cleanup := testDB(t)
+	defer cleanup()
+	seller := testUser(t, db, "seller", 10)
+	buyer := testUser(t, db, "buyer", 0)
+
+	sell := testAddOrder(t, db, OrderTypeSell, seller, 5, 1000, OrderOption{})
+	buy1 := testAddOrder(t, db, OrderTypeBuy, buyer, 2, 1000, OrderOption{})
+	if err := RunTrade(db); err != nil {
+		t.Fatalf("RunTrade failed. err:%s", err)
+	}
+
+	o := testGetOrder(t, db, sell.ID)
+	if o.FilledAmount != 2 || o.Status != OrderStatusOpen || o.ClosedAt != nil {
+		t.Errorf("sell order after first trade: filled:%d status:%s", o.FilledAmount, o.Status)
+	}
+	if len(o.Fills) != 1 || filledByFills(o) != 2 {
+		t.Errorf("sell order fills after first trade: %+v", o.Fills)
+	}
+	if o := book.get(sell.ID); o == nil || o.RemainingAmount() != 3 {
+		t.Errorf("sell order in book after first trade: %+v", o)
+	}
+	o = testGetOrder(t, db, buy1.ID)
+	if o.FilledAmount != 2 || o.Status != OrderStatusTraded || o.ClosedAt == nil || filledByFills(o) != 2 {
+		t.Errorf("buy order 1: filled:%d status:%s fills:%+v", o.FilledAmount, o.Status, o.Fills)
+	}
+
+	buy2 := testAddOrder(t, db, OrderTypeBuy, buyer, 4, 1000, OrderOption{})
+	if err := RunTrade(db); err != nil {
+		t.Fatalf("RunTrade failed. err:%s", err)
+	}
+	o = testGetOrder(t, db, sell.ID)
+	if o.FilledAmount != 5 || o.Status != OrderStatusTraded || len(o.Fills) != 2 || filledByFills(o) != 5 {
+		t.Errorf("sell order after second trade: filled:%d status:%s fills:%+v", o.FilledAmount, o.Status, o.Fills)
+	}
+	if len(o.Fills) == 2 && o.Fills[0].TradeID == o.Fills[1].TradeID {
+		t.Errorf("fills must belong to different trades: %+v", o.Fills)
+	}
+	if len(o.Fills) == 2 && o.TradeID != o.Fills[1].TradeID {
+		t.Errorf("trade_id must be the last fill: got %d, want %d", o.TradeID, o.Fills[1].TradeID)
+	}
+	if book.get(sell.ID) != nil {
+		t.Error("traded sell order remains in book")
+	}
+	o = testGetOrder(t, db, buy2.ID)
+	if o.FilledAmount != 3 || o.Status != OrderStatusOpen || filledByFills(o) != 3 {
+		t.Errorf("buy order 2: filled:%d status:%s fills:%+v", o.FilledAmount, o.Status, o.Fills)
+	}
+
+	if isu, err := GetIsuHolding(db, seller); err != nil || isu != 5 {
+		t.Errorf("seller isu: got %d, want 5 err:%v", isu, err)
+	}
+	if isu, err := GetIsuHolding(db, buyer); err != nil || isu != 5 {
+		t.Errorf("buyer isu: got %d, want 5 err:%v", isu, err)
+	}
+}
+
+func TestImmediateOrderCancelReason(t *testing.T) {
+	db, cleanup := testDB(t)
+	defer cleanup()
+	seller := testUser(t, db, "seller", 10)
+	buyer := testUser(t, db, "buyer", 0)
+	testAddOrder(t, db, OrderTypeSell, seller, 1, 1000, OrderOption{})
+
+	m := NewMatcher(db)
+	go m.Run()
+	defer m.Shutdown(context.Background())
+
+	for _, tc := range []struct {
+		tif    string
+		filled int64
+		reason string
+	}{
+		// FOKは全て成立しないため1脚も取引しない
+		{TimeInForceFOK, 0, CancelReasonFOK},
+		// IOCは成立した1脚を取引し、残りを取り消す
+		{TimeInForceIOC, 1, CancelReasonIOC},
+		// 相手注文が無い場合も取り消す
+		{TimeInForceIOC, 0, CancelReasonIOC},
+	} {
+		order := testAddOrder(t, db, OrderTypeBuy, buyer, 3, 1000, OrderOption{TimeInForce: tc.tif})
+		m.Submit(order.ID)
+		m.Drain()
+		o := testGetOrder(t, db, order.ID)
+		if o.Status != OrderStatusCanceled || o.CloseReason != tc.reason {
+			t.Errorf("%s order: status:%s reason:%s, want reason %s", tc.tif, o.Status, o.CloseReason, tc.reason)
+		}
+		if o.FilledAmount != tc.filled || filledByFills(o) != tc.filled {
+			t.Errorf("%s order: filled:%d fills:%+v, want %d", tc.tif, o.FilledAmount, o.Fills, tc.filled)
+		}
+		if book.get(order.ID) != nil {
+			t.Errorf("%s order is in book", tc.tif)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package model
 
 import (
 	"database/sql"
+	"isucon8/isubank"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,6 +23,22 @@ func GetUserByID(d QueryExecutor, id int64) (*User, error) {
 	return scanUser(d.Query("SELECT * FROM user WHERE id = ?", id))
 }
 
+func getUsersByIDs(d QueryExecutor, ids []int64) (map[int64]*User, error) {
+	res := make(map[int64]*User, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	query, args := inQuery("SELECT * FROM user WHERE id IN (%s)", ids)
+	users, err := scanUsers(d.Query(query, args...))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		res[u.ID] = u
+	}
+	return res, nil
+}
+
 func getUserByIDWithLock(tx *sql.Tx, id int64) (*User, error) {
 	return scanUser(tx.Query("SELECT * FROM user WHERE id = ? FOR UPDATE", id))
 }
@@ -31,8 +49,11 @@ func UserSignup(tx *sql.Tx, name, bankID, password string) error {
 		return err
 	}
 	// bankIDの検証
-	if err = bank.Check(bankID, 0); err != nil {
+	switch err = bank.Check(bankID, 0); {
+	case isubank.IsNoUser(err):
 		return ErrBankUserNotFound
+	case err != nil:
+		return errors.Wrap(err, "isubank check failed")
 	}
 	pass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -50,11 +71,16 @@ func UserSignup(tx *sql.Tx, name, bankID, password string) error {
 		if err != nil {
 			return err
 		}
-		sendLog(tx, "signup", map[string]interface{}{
+		if err = addInitialIsu(tx, userID); err != nil {
+			return err
+		}
+		if err = sendLog(tx, "signup", map[string]interface{}{
 			"bank_id": bankID,
 			"user_id": userID,
 			"name":    name,
-		})
+		}); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -73,8 +99,10 @@ func UserLogin(d QueryExecutor, bankID, password string) (*User, error) {
 		}
 		return nil, err
 	}
-	sendLog(d, "signin", map[string]interface{}{
+	if err = sendLog(d, "signin", map[string]interface{}{
 		"user_id": user.ID,
-	})
+	}); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
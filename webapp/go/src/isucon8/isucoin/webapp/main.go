@@ -1,23 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"isucon8/isucoin/controller"
+	"isucon8/isucoin/model"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	gctx "github.com/gorilla/context"
-	"github.com/gorilla/sessions"
 	"github.com/julienschmidt/httprouter"
 )
 
-const (
-	SessionSecret = "tonymoris"
-)
-
 func init() {
 	var err error
 	loc, err := time.LoadLocation("Asia/Tokyo")
@@ -34,6 +36,52 @@ func getEnv(key, def string) string {
 	return def
 }
 
+// sessionKeyPairs はカンマ区切りのセッション鍵をsecurecookieの鍵ペアに変換します
+// 各鍵は "署名鍵" または "署名鍵:暗号化鍵" の形式で、先頭の鍵で署名し、全ての鍵で検証します
+func sessionKeyPairs(v string) [][]byte {
+	pairs := [][]byte{}
+	for _, key := range strings.Split(v, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		kv := strings.SplitN(key, ":", 2)
+		if len(kv) == 2 {
+			pairs = append(pairs, []byte(kv[0]), []byte(kv[1]))
+		} else {
+			pairs = append(pairs, []byte(kv[0]), nil)
+		}
+	}
+	if len(pairs) == 0 {
+		log.Fatalf("session keys are empty. set ISU_SESSION_KEYS")
+	}
+	return pairs
+}
+
+// trustedProxies はカンマ区切りのIPアドレスまたはCIDRをX-Forwarded-Forを信用するアドレスに変換します
+func trustedProxies(v string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, addr := range strings.Split(v, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "/") {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+				addr += "/32"
+			} else {
+				addr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			log.Fatalf("invalid ISU_TRUSTED_PROXIES. err: %s", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
 func main() {
 	var (
 		port   = getEnv("APP_PORT", "5000")
@@ -55,22 +103,118 @@ func main() {
 	if err != nil {
 		log.Fatalf("mysql connect failed. err: %s", err)
 	}
-	store := sessions.NewCookieStore([]byte(SessionSecret))
+	if err = model.InitOrderBook(db); err != nil {
+		log.Fatalf("init order book failed. err: %s", err)
+	}
+	if v := getEnv("LOGIN_IP_FAILURE_LIMIT", ""); v != "" {
+		// IPアドレスごとのログイン失敗回数の上限。未指定の場合はIPアドレスでの制限を行わない
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid ISU_LOGIN_IP_FAILURE_LIMIT. err: %s", err)
+		}
+		model.LoginFailureIPLimit = limit
+	}
+	// X-Forwarded-Forを信用するリバースプロキシ。未指定の場合は接続元のアドレスでIPアドレスごとの制限を行う
+	controller.TrustedProxies = trustedProxies(getEnv("TRUSTED_PROXIES", ""))
+	if v := getEnv("EXECUTION_PRICE_POLICY", ""); v != "" {
+		// 取引の単価の決め方(aggressor, resting, midpoint)。未指定の場合は板の注文の単価(resting)で取引する
+		policy, ok := model.GetPricePolicy(v)
+		if !ok {
+			log.Fatalf("invalid ISU_EXECUTION_PRICE_POLICY. %s", v)
+		}
+		model.ExecutionPricePolicy = policy
+	}
+	store := controller.NewDBSessionStore(db, sessionKeyPairs(getEnv("SESSION_KEYS", ""))...)
+
+	matcher := model.NewMatcher(db)
+	go matcher.Run()
+	// 起動前に成立可能になっていた注文や処理途中だったIOC/FOK注文を処理する
+	immediate, err := model.GetOpenImmediateOrders(db)
+	if err != nil {
+		log.Fatalf("get immediate orders failed. err: %s", err)
+	}
+	for _, order := range immediate {
+		matcher.Submit(order.ID)
+	}
+	matcher.Trigger()
 
-	h := controller.NewHandler(db, store)
+	// 有効期限を過ぎた注文を取り消す
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	reaperDone := make(chan struct{})
+	go func() {
+		defer close(reaperDone)
+		model.RunOrderReaper(reaperCtx, db, time.Second)
+	}()
+
+	// コミットされたログをISULOGに送信する
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		model.RunLogRelay(relayCtx, db, 500*time.Millisecond)
+	}()
+
+	h := controller.NewHandler(db, store, matcher)
 
 	router := httprouter.New()
 	router.POST("/initialize", h.Initialize)
 	router.POST("/signup", h.Signup)
 	router.POST("/signin", h.Signin)
 	router.POST("/signout", h.Signout)
+	router.POST("/signout_all", h.SignoutAll)
 	router.GET("/info", h.Info)
+	router.GET("/candles", h.GetCandles)
+	router.GET("/orderbook", h.GetOrderBook)
 	router.POST("/orders", h.AddOrders)
+	router.POST("/orders/batch", h.AddOrdersBatch)
 	router.GET("/orders", h.GetOrders)
+	router.DELETE("/orders", h.DeleteOrdersBatch)
+	router.PUT("/order/:id", h.AmendOrder)
 	router.DELETE("/order/:id", h.DeleteOrders)
+	router.DELETE("/stop_order/:id", h.DeleteStopOrder)
+	router.GET("/balance", h.GetBalance)
+	router.GET("/portfolio", h.GetPortfolio)
+	router.GET("/portfolio/history", h.GetPortfolioHistory)
+	router.GET("/stream", h.Stream)
 	router.NotFound = http.FileServer(http.Dir(public)).ServeHTTP
 
 	addr := ":" + port
+	server := &http.Server{
+		Addr:    addr,
+		Handler: gctx.ClearHandler(h.CommonMiddleware(router)),
+	}
+	// ストリームの接続は終了しないため、Shutdown時に切断する
+	server.RegisterOnShutdown(model.CloseStreams)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("[WARN] server shutdown failed. err: %s", err)
+		}
+		stopReaper()
+		<-reaperDone
+		if err := matcher.Shutdown(ctx); err != nil {
+			log.Printf("[WARN] matcher shutdown failed. err: %s", err)
+		}
+		// 送信待ちのログを送信してから終了する
+		stopRelay()
+		<-relayDone
+		if err := model.RelayLogs(ctx, db); err != nil {
+			log.Printf("[WARN] relay logs failed. err: %s", err)
+		}
+		if err := model.CloseLogShipper(ctx); err != nil {
+			log.Printf("[WARN] log shipper close failed. err: %s", err)
+		}
+	}()
+
 	log.Printf("[INFO] start server %s", addr)
-	log.Fatal(http.ListenAndServe(addr, gctx.ClearHandler(h.CommonMiddleware(router))))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
 }
@@ -12,6 +12,24 @@ import (
 	"time"
 )
 
+// MaxBodySize は1回のリクエストで送信できるbodyの最大サイズです
+const MaxBodySize = 1024 * 1024
+
+// StatusError はISULOGが200以外のステータスを返したことを表します
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("logger status is not ok. code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// Temporary は時間を置いて再送すれば成功する可能性があるかを返します
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
 // Log はIsuloggerに送るためのログフォーマット
 type Log struct {
 	// Tagは各ログを識別するための情報です
@@ -25,6 +43,7 @@ type Log struct {
 type Isulogger struct {
 	endpoint *url.URL
 	appID    string
+	client   *http.Client
 }
 
 // NewIsulogger はIsuloggerを初期化します
@@ -32,6 +51,12 @@ type Isulogger struct {
 // endpoint: ISULOGを利用するためのエンドポイントURI
 // appID:    ISULOGを利用するためのアプリケーションID
 func NewIsulogger(endpoint, appID string) (*Isulogger, error) {
+	return NewIsuloggerWithClient(endpoint, appID, http.DefaultClient)
+}
+
+// NewIsuloggerWithClient はリクエストに使うhttp.Clientを指定してIsuloggerを初期化します
+// Isuloggerは複数のgoroutineから利用できるため、clientと共に使い回してください
+func NewIsuloggerWithClient(endpoint, appID string, client *http.Client) (*Isulogger, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
@@ -39,6 +64,7 @@ func NewIsulogger(endpoint, appID string) (*Isulogger, error) {
 	return &Isulogger{
 		endpoint: u,
 		appID:    appID,
+		client:   client,
 	}, nil
 }
 
@@ -51,6 +77,18 @@ func (b *Isulogger) Send(tag string, data interface{}) error {
 	})
 }
 
+// SendBulk は複数のログをまとめて送信します
+// bodyがMaxBodySizeを超える場合はエラーになるため、呼び出し側で分割してください
+func (b *Isulogger) SendBulk(logs []Log) error {
+	return b.request("/send_bulk", logs)
+}
+
+// SendBulkRaw はJSONにエンコード済みのログをまとめて送信します
+// bodyがMaxBodySizeを超える場合はエラーになるため、呼び出し側で分割してください
+func (b *Isulogger) SendBulkRaw(logs []json.RawMessage) error {
+	return b.request("/send_bulk", logs)
+}
+
 func (b *Isulogger) request(p string, v interface{}) error {
 	u := new(url.URL)
 	*u = *b.endpoint
@@ -68,7 +106,7 @@ func (b *Isulogger) request(p string, v interface{}) error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+b.appID)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := b.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("logger request failed. err: %s", err)
 	}
@@ -80,5 +118,5 @@ func (b *Isulogger) request(p string, v interface{}) error {
 	if res.StatusCode == http.StatusOK {
 		return nil
 	}
-	return fmt.Errorf("logger status is not ok. code: %d, body: %s", res.StatusCode, string(bo))
+	return &StatusError{StatusCode: res.StatusCode, Body: string(bo)}
 }
@@ -0,0 +1,192 @@
+package isulogger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrShipperClosed はClose後にログを送ろうとしたことを表します
+var ErrShipperClosed = errors.New("shipper is closed")
+
+// ErrBufferFull は送信待ちのログが上限に達したことを表します
+var ErrBufferFull = errors.New("shipper buffer is full")
+
+// ErrLogTooLarge は1件でMaxBodySizeを超えるログを送ろうとしたことを表します
+var ErrLogTooLarge = errors.New("log is too large")
+
+// ShipperOption はShipperの設定です。ゼロ値の項目は既定値を使います
+type ShipperOption struct {
+	// FlushInterval は送信待ちのログを送信する間隔です (既定値 500ms)
+	FlushInterval time.Duration
+	// MaxBatchSize は1回のリクエストで送信するログの最大件数です (既定値 1000)
+	MaxBatchSize int
+	// MaxBodySize は1回のリクエストのbodyの最大サイズです (既定値 MaxBodySize)
+	MaxBodySize int
+	// BufferSize は送信待ちにできるログの件数です。超えたログは破棄します (既定値 10000)
+	BufferSize int
+	// MaxRetries は送信に失敗したときに再送する回数です。負の値の場合は再送しません (既定値 5)
+	MaxRetries int
+	// RetryBackoff は最初の再送までの待ち時間です。再送のたびに倍にします (既定値 100ms)
+	RetryBackoff time.Duration
+	// MaxRetryBackoff は再送までの待ち時間の上限です (既定値 2s)
+	MaxRetryBackoff time.Duration
+}
+
+func (o *ShipperOption) setDefaults() {
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 500 * time.Millisecond
+	}
+	if o.MaxBatchSize <= 0 {
+		o.MaxBatchSize = 1000
+	}
+	if o.MaxBodySize <= 0 || o.MaxBodySize > MaxBodySize {
+		o.MaxBodySize = MaxBodySize
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = 10000
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	} else if o.MaxRetries == 0 {
+		o.MaxRetries = 5
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 100 * time.Millisecond
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = 2 * time.Second
+	}
+}
+
+// Shipper はログをバッファし、バックグラウンドで /send_bulk によってまとめて送信します
+// 件数がMaxBatchSizeに達するか、bodyがMaxBodySizeを超えるか、FlushIntervalが経過すると送信します
+// NewShipperで初期化し、終了時にはCloseで送信待ちのログを送信してください
+type Shipper struct {
+	logger *Isulogger
+	opt    ShipperOption
+
+	mu     sync.RWMutex
+	ch     chan json.RawMessage
+	closed bool
+	done   chan struct{}
+}
+
+// NewShipper はShipperを初期化し、送信を開始します
+func NewShipper(logger *Isulogger, opt ShipperOption) *Shipper {
+	opt.setDefaults()
+	s := &Shipper{
+		logger: logger,
+		opt:    opt,
+		ch:     make(chan json.RawMessage, opt.BufferSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Send はログを送信待ちに追加します。送信の完了は待ちません
+func (s *Shipper) Send(tag string, data interface{}) error {
+	b, err := json.Marshal(Log{
+		Tag:  tag,
+		Time: time.Now(),
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+	// 配列の括弧と改行を含めて1件でも送信できないログは受け付けない
+	if len(b)+3 > s.opt.MaxBodySize {
+		return ErrLogTooLarge
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrShipperClosed
+	}
+	select {
+	case s.ch <- b:
+		return nil
+	default:
+		return ErrBufferFull
+	}
+}
+
+// Close は新たなログの受け付けを止め、送信待ちのログを全て送信するかctxが終了するまで待ちます
+func (s *Shipper) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Shipper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opt.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]json.RawMessage, 0, s.opt.MaxBatchSize)
+	// size は "[" + 各ログを","で区切ったもの + "]\n" のbodyのサイズです
+	size := 3
+	flush := func() {
+		if len(batch) > 0 {
+			s.ship(batch)
+		}
+		batch = make([]json.RawMessage, 0, s.opt.MaxBatchSize)
+		size = 3
+	}
+	for {
+		select {
+		case b, ok := <-s.ch:
+			if !ok {
+				flush()
+				return
+			}
+			add := len(b)
+			if len(batch) > 0 {
+				add++
+			}
+			if size+add > s.opt.MaxBodySize {
+				flush()
+				add = len(b)
+			}
+			batch = append(batch, b)
+			size += add
+			if len(batch) >= s.opt.MaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// ship はログを送信し、一時的なエラーの場合は間隔を空けて再送します
+func (s *Shipper) ship(batch []json.RawMessage) {
+	backoff := s.opt.RetryBackoff
+	for i := 0; ; i++ {
+		err := s.logger.request("/send_bulk", batch)
+		if err == nil {
+			return
+		}
+		if se, ok := err.(*StatusError); (ok && !se.Temporary()) || i >= s.opt.MaxRetries {
+			log.Printf("[WARN] logger send_bulk failed. %d logs are dropped. err:%s", len(batch), err)
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > s.opt.MaxRetryBackoff {
+			backoff = s.opt.MaxRetryBackoff
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -33,8 +35,10 @@ func main() {
 	server := http.NewServeMux()
 	server.HandleFunc("/check", dumpHandler)
 	server.HandleFunc("/reserve", reserveHandler)
+	server.HandleFunc("/reserve_bulk", reserveBulkHandler)
 	server.HandleFunc("/commit", dumpHandler)
 	server.HandleFunc("/cancel", dumpHandler)
+	server.HandleFunc("/credit", creditHandler)
 
 	// default 404
 	server.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -72,6 +76,42 @@ func reserveHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, fmt.Sprintf(`{"reserve_id":%d}`, v))
 }
 
+func reserveBulkHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(logw, "%s %s\n", r.Method, r.URL.Path)
+	defer r.Body.Close()
+	body := &bytes.Buffer{}
+	if _, err := io.Copy(io.MultiWriter(logw, body), r.Body); err != nil {
+		log.Printf("dump body failed")
+	}
+	fmt.Fprintf(logw, "--\n")
+
+	var req struct {
+		Reserves []json.RawMessage `json:"reserves"`
+	}
+	if err := json.Unmarshal(body.Bytes(), &req); err != nil || len(req.Reserves) == 0 {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `{"error":"paramater invalid"}`)
+		return
+	}
+	type result struct {
+		Status    int   `json:"status"`
+		ReserveID int64 `json:"reserve_id"`
+	}
+	results := make([]result, len(req.Reserves))
+	for i := range results {
+		results[i] = result{Status: http.StatusOK, ReserveID: atomic.AddInt64(&receiveID, 1)}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+func creditHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(logw, "%s %s?%s\n--\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, `{"credit":0}`)
+}
+
 func init() {
 	var err error
 	loc, err := time.LoadLocation(LocationName)
@@ -22,14 +22,40 @@ CREATE TABLE orders (
     user_id BIGINT NOT NULL,
     amount BIGINT NOT NULL,
     price BIGINT NOT NULL,
+    order_type VARCHAR(8) NOT NULL DEFAULT 'limit',
+    time_in_force VARCHAR(3) NOT NULL DEFAULT 'GTC',
+    expire_at DATETIME(6),
+    filled_amount BIGINT NOT NULL DEFAULT 0,
+    fee BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(8) NOT NULL DEFAULT 'open',
+    close_reason VARCHAR(32) NOT NULL DEFAULT '',
     closed_at DATETIME(6),
     trade_id BIGINT,
     created_at DATETIME(6) NOT NULL,
     INDEX type_closed_at_idx(type, closed_at),
-    INDEX user_id_idx(user_id),
+    INDEX user_id_status_idx(user_id, status),
+    INDEX expire_at_idx(expire_at),
     PRIMARY KEY (id, created_at)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
 
+CREATE TABLE stop_orders (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    type VARCHAR(4) NOT NULL,
+    user_id BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    price BIGINT NOT NULL,
+    stop_price BIGINT NOT NULL,
+    order_type VARCHAR(8) NOT NULL DEFAULT 'limit',
+    status VARCHAR(16) NOT NULL DEFAULT 'pending_trigger',
+    close_reason VARCHAR(32) NOT NULL DEFAULT '',
+    order_id BIGINT NOT NULL DEFAULT 0,
+    closed_at DATETIME(6),
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX status_type_stop_price_idx(status, type, stop_price),
+    INDEX user_id_status_idx(user_id, status)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
 CREATE TABLE trade (
     id BIGINT NOT NULL AUTO_INCREMENT,
     amount BIGINT NOT NULL,
@@ -37,3 +63,75 @@ CREATE TABLE trade (
     created_at DATETIME(6) NOT NULL,
     PRIMARY KEY (id, created_at)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE order_fill (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    order_id BIGINT NOT NULL,
+    trade_id BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    fee BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX order_id_idx(order_id),
+    INDEX trade_id_idx(trade_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE isu_ledger (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    order_id BIGINT NOT NULL,
+    trade_id BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX user_id_amount_idx(user_id, amount)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE log_outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    tag VARCHAR(64) NOT NULL,
+    data MEDIUMBLOB NOT NULL,
+    sent_at DATETIME(6),
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX sent_at_id_idx(sent_at, id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE login_failure (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    login_key VARBINARY(191) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX login_key_created_at_idx(login_key, created_at)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE login_lock (
+    login_key VARBINARY(191) NOT NULL,
+    locked_until DATETIME(6) NOT NULL,
+    PRIMARY KEY (login_key)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE session (
+    id VARBINARY(64) NOT NULL,
+    user_id BIGINT NOT NULL,
+    data BLOB NOT NULL,
+    expires_at DATETIME(6) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX user_id_idx(user_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE candlestick (
+    resolution VARCHAR(8) NOT NULL,
+    t DATETIME NOT NULL,
+    open BIGINT NOT NULL,
+    close BIGINT NOT NULL,
+    high BIGINT NOT NULL,
+    low BIGINT NOT NULL,
+    volume BIGINT NOT NULL,
+    trade_count BIGINT NOT NULL,
+    turnover BIGINT NOT NULL,
+    open_trade_id BIGINT NOT NULL,
+    close_trade_id BIGINT NOT NULL,
+    PRIMARY KEY (resolution, t)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;